@@ -0,0 +1,164 @@
+package thumbnailer
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// The headers of the callback requests. The signature is the hex encoded
+// HMAC-SHA256 of the timestamp, a dot and the body, keyed by the secret of
+// the Thumbnailer. It is omitted when the Thumbnailer has no secret.
+const (
+	CallbackTimestampHeader = "X-Thumbnailer-Timestamp"
+	CallbackSignatureHeader = "X-Thumbnailer-Signature"
+)
+
+// DefaultCallbackTimeout bounds each attempt of a callback request.
+const DefaultCallbackTimeout = 10 * time.Second
+
+// errCallbackRejected is returned when the callback URL refuses the request,
+// it is not retried.
+var errCallbackRejected = errors.New("Callback rejected")
+
+// retryableCallback tells if a callback request which failed with err may
+// succeed later.
+func retryableCallback(err error) bool {
+	return !errors.Is(err, errCallbackRejected) && !errors.Is(err, ErrCircuitOpen)
+}
+
+// Callback is the body posted to the CallbackURL of a ThumbnailerMessage once
+// it is processed.
+type Callback struct {
+	SrcImage string           `json:"srcImage"`
+	Status   string           `json:"status"`
+	Error    string           `json:"error,omitempty"`
+	Results  []CallbackResult `json:"results"`
+}
+
+// CallbackResult is the JSON representation of a ThumbnailResult.
+type CallbackResult struct {
+	Thumbnail  string `json:"thumbnail,omitempty"`
+	Error      string `json:"error,omitempty"`
+	Skipped    bool   `json:"skipped,omitempty"`
+	SourceHash string `json:"sourceHash,omitempty"`
+}
+
+// CallbackResults converts results to their JSON representation.
+func CallbackResults(results []ThumbnailResult) []CallbackResult {
+	callbackResults := make([]CallbackResult, 0, len(results))
+	for _, r := range results {
+		cr := CallbackResult{Skipped: r.Skipped, SourceHash: r.SourceHash}
+		if r.Thumbnail != nil {
+			cr.Thumbnail = r.Thumbnail.String()
+		}
+		if r.Err != nil {
+			cr.Error = r.Err.Error()
+		}
+		callbackResults = append(callbackResults, cr)
+	}
+	return callbackResults
+}
+
+// newCallback returns the Callback of tm processed with results and err.
+func newCallback(tm *ThumbnailerMessage, results []ThumbnailResult, err error) Callback {
+	c := Callback{SrcImage: tm.SrcImage, Status: "done", Results: CallbackResults(results)}
+	if err != nil {
+		c.Status = "failed"
+		c.Error = err.Error()
+	}
+	return c
+}
+
+// callbacks sends the callback requests.
+type callbacks struct {
+	secret  []byte
+	client  *http.Client
+	retrier *retrier
+}
+
+func newCallbacks(secret string, timeout time.Duration, p RetryPolicy) *callbacks {
+	return &callbacks{
+		secret:  []byte(secret),
+		client:  &http.Client{Timeout: timeout},
+		retrier: &retrier{ctx: context.Background(), policy: p, retryable: retryableCallback, breakers: map[string]*breaker{}},
+	}
+}
+
+// Notify posts payload encoded in JSON to callbackURL, the request is signed
+// and retried as configured by WithCallbacks. The responses with a 4xx
+// status, but 429, are not retried.
+func (t *Thumbnailer) Notify(callbackURL string, payload interface{}) error {
+	u, err := parseCallbackURL(callbackURL)
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	c := t.callbacks
+	return c.retrier.do(c.retrier.breaker(u), func() error {
+		return c.post(u, body)
+	})
+}
+
+func (c *callbacks) post(u *url.URL, body []byte) error {
+	req, err := http.NewRequest("POST", u.String(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "thumbnailer/"+Version)
+	req.Header.Set(CallbackTimestampHeader, timestamp)
+	if len(c.secret) > 0 {
+		req.Header.Set(CallbackSignatureHeader, "sha256="+SignCallback(c.secret, timestamp, body))
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	switch {
+	case resp.StatusCode/100 == 2:
+		return nil
+	case resp.StatusCode/100 == 4 && resp.StatusCode != http.StatusTooManyRequests:
+		return fmt.Errorf("%w by %s: %s", errCallbackRejected, u, resp.Status)
+	default:
+		return fmt.Errorf("Callback to %s failed: %s", u, resp.Status)
+	}
+}
+
+// SignCallback returns the signature of a callback request, without its
+// "sha256=" prefix.
+func SignCallback(secret []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func parseCallbackURL(callbackURL string) (*url.URL, error) {
+	u, err := url.Parse(callbackURL)
+	if err != nil {
+		return nil, err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("Unsupported callback URL: %q", callbackURL)
+	}
+	return u, nil
+}
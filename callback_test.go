@@ -0,0 +1,97 @@
+package thumbnailer
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_ProcessCallback(t *testing.T) {
+	data, err := ioutil.ReadFile(filepath.Join("testdata", "pic.jpg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret := "s3cr3t"
+	calls := 0
+	callbacks := make(chan Callback, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		// The first attempt fails, it is retried
+		if calls == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		signature := "sha256=" + SignCallback([]byte(secret), r.Header.Get(CallbackTimestampHeader), body)
+		if r.Header.Get(CallbackSignatureHeader) != signature {
+			t.Errorf("got signature %q, expected %q", r.Header.Get(CallbackSignatureHeader), signature)
+		}
+		var c Callback
+		if err := json.Unmarshal(body, &c); err != nil {
+			t.Error(err)
+		}
+		callbacks <- c
+	}))
+	defer srv.Close()
+
+	m := NewMemStorage()
+	m.Put("src/pic.jpg", data)
+	policy := RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond}
+	th := New(WithStorage("mem", m.Storage), WithCallbacks(secret, time.Second, policy))
+	tm := ThumbnailerMessage{
+		SrcImage:    "mem://src/pic.jpg",
+		DstFolder:   "mem://dst",
+		Opts:        []ThumbnailOpt{{Width: 100}},
+		CallbackURL: srv.URL,
+	}
+	if _, err := th.Process(&tm); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case c := <-callbacks:
+		if c.Status != "done" || c.SrcImage != tm.SrcImage || len(c.Results) != 1 || c.Results[0].Thumbnail != "mem://dst/pic_s100x75.jpg" {
+			t.Fatalf("unexpected callback: %+v", c)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the callback was not received")
+	}
+
+	// The failures are notified too
+	tm.SrcImage = "mem://src/missing.jpg"
+	if _, err := th.Process(&tm); err == nil {
+		t.Fatal("expected an error for the missing source")
+	}
+	select {
+	case c := <-callbacks:
+		if c.Status != "failed" || c.Error == "" {
+			t.Fatalf("unexpected callback: %+v", c)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the callback was not received")
+	}
+}
+
+func Test_NotifyRejected(t *testing.T) {
+	calls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if r.Header.Get(CallbackSignatureHeader) != "" {
+			t.Error("expected an unsigned request")
+		}
+		w.WriteHeader(http.StatusGone)
+	}))
+	defer srv.Close()
+
+	th := New(WithCallbacks("", time.Second, RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond}))
+	if err := th.Notify(srv.URL, Callback{}); err == nil || calls != 1 {
+		t.Fatalf("expected a rejection without retry, got %v after %d calls", err, calls)
+	}
+	if err := th.Notify("ftp://example.com/hook", Callback{}); err == nil || !strings.Contains(err.Error(), "Unsupported") {
+		t.Fatalf("expected an unsupported callback URL, got %v", err)
+	}
+}
@@ -14,6 +14,7 @@ import (
 	"strings"
 
 	"github.com/yml/thumbnailer"
+	"github.com/yml/thumbnailer/config"
 )
 
 var (
@@ -25,6 +26,9 @@ var (
 	thumbOpts         string
 	postURL           string
 	preserveStructure bool
+	overwrite         string
+	presetsFile       string
+	presetNames       string
 	tOpts             []thumbnailer.ThumbnailOpt
 )
 
@@ -34,6 +38,9 @@ func init() {
 	flag.StringVar(&thumbOpts, "thumbnail-options", "", "Thumbnail options")
 	flag.StringVar(&postURL, "post-url", "", "Url to post the thumbnail generation request")
 	flag.BoolVar(&preserveStructure, "preserve-structure", false, "Preseve the folder structure from `src-directory` to `dst-directory`")
+	flag.StringVar(&presetsFile, "presets", "", "JSON file of the named thumbnail presets")
+	flag.StringVar(&presetNames, "thumbnail-presets", "", "Comma separated names of the presets added to the `thumbnail-options`")
+	flag.StringVar(&overwrite, "overwrite", "always", "What to do with the existing thumbnails: always, never or if-older")
 }
 
 func thumbnailFileRequest(file string) error {
@@ -41,7 +48,7 @@ func thumbnailFileRequest(file string) error {
 	if preserveStructure {
 		rel, err := filepath.Rel(srcPath, file)
 		if err != nil {
-			return fmt.Errorf("[ERROR] failed to retrieve the relative path", err)
+			return fmt.Errorf("[ERROR] failed to retrieve the relative path, %s", err)
 		}
 		dstPath = fmt.Sprintf("%s%s", dstDir, filepath.Dir(rel))
 	} else {
@@ -51,7 +58,11 @@ func thumbnailFileRequest(file string) error {
 		SrcImage:  fmt.Sprintf("file://%s", file),
 		DstFolder: dstPath,
 		Opts:      tOpts,
+		Overwrite: thumbnailer.Overwrite(overwrite),
 	})
+	if err != nil {
+		return fmt.Errorf("[ERROR] An error occured while encoding the thumbnail generation request, %s", err)
+	}
 
 	resp, err := http.Post(postURL, "application/json", bytes.NewReader(tmJson))
 	if err != nil {
@@ -63,11 +74,11 @@ func thumbnailFileRequest(file string) error {
 	// consume the entire response body
 	_, err = io.Copy(ioutil.Discard, resp.Body)
 	if err != nil {
-		return fmt.Errorf("An error occured while reading resp.Body", err)
+		return fmt.Errorf("An error occured while reading resp.Body, %s", err)
 	}
 	err = resp.Body.Close()
 	if err != nil {
-		return fmt.Errorf("An error occured while closing resp.Body", err)
+		return fmt.Errorf("An error occured while closing resp.Body, %s", err)
 	}
 	return nil
 }
@@ -96,40 +107,81 @@ func fileWalk(p string) {
 
 func main() {
 	var srcURL *url.URL
-	flag.Parse()
+	conf, err := config.Parse(flag.CommandLine, os.Args[1:])
+	if err != nil {
+		fmt.Printf("\n%s\n\n", err)
+		flag.Usage()
+		return
+	}
+	if conf.PrintConfig {
+		conf.Print(os.Stdout)
+		return
+	}
 	if srcDir == "" {
-		fmt.Println("\nbulk-loader requires a `src-directory`\n")
+		fmt.Print("\nbulk-loader requires a `src-directory`\n\n")
 		flag.Usage()
 		return
 	}
-	srcURL, err := url.Parse(srcDir)
+	srcURL, err = url.Parse(srcDir)
 	if err != nil {
-		fmt.Println("\nfailed to parse srcDir into an URL, %s \n\n")
+		fmt.Printf("\nfailed to parse srcDir into an URL, %s \n\n", err)
 		flag.Usage()
 		return
 	}
 
 	if dstDir == "" {
-		fmt.Println("\nbulk-loader requires a `dst-directory`\n")
+		fmt.Print("\nbulk-loader requires a `dst-directory`\n\n")
 		flag.Usage()
 		return
 	}
 	if postURL == "" {
-		fmt.Println("\nbulk-loader requires a `post-url`\n")
+		fmt.Print("\nbulk-loader requires a `post-url`\n\n")
 		flag.Usage()
 		return
 	}
-	if thumbOpts == "" {
-		fmt.Println("\nbulk-loader requires a `thumbnail-options`\n")
+	switch thumbnailer.Overwrite(overwrite) {
+	case thumbnailer.OverwriteAlways, thumbnailer.OverwriteNever, thumbnailer.OverwriteIfOlder:
+	default:
+		fmt.Printf("\nUnsupported overwrite value: %s\n\n", overwrite)
 		flag.Usage()
 		return
 	}
-	err = json.Unmarshal([]byte(thumbOpts), &tOpts)
-	if err != nil {
-		fmt.Printf("\nFailed to parse the thumbnail-options, %s \n\n", err)
+	if thumbOpts == "" && presetNames == "" {
+		fmt.Print("\nbulk-loader requires a `thumbnail-options` or `thumbnail-presets`\n\n")
 		flag.Usage()
 		return
 	}
+	if thumbOpts != "" {
+		err = json.Unmarshal([]byte(thumbOpts), &tOpts)
+		if err != nil {
+			fmt.Printf("\nFailed to parse the thumbnail-options, %s \n\n", err)
+			flag.Usage()
+			return
+		}
+	}
+	if presetNames != "" {
+		presets := conf.Presets
+		if presets == nil && presetsFile == "" {
+			fmt.Print("\nbulk-loader requires `presets` to use `thumbnail-presets`\n\n")
+			flag.Usage()
+			return
+		}
+		if presets == nil {
+			presets, err = thumbnailer.ReadPresets(presetsFile)
+			if err != nil {
+				fmt.Printf("\nFailed to read the presets, %s \n\n", err)
+				return
+			}
+		}
+		// The presets are resolved here, so the consumer does not need them
+		opts, err := presets.Opts(strings.Split(presetNames, ","))
+		if err != nil {
+			fmt.Printf("\n%s \n\n", err)
+			flag.Usage()
+			return
+		}
+		tOpts = append(tOpts, opts...)
+	}
 
 	if srcURL.Scheme == "file" {
 		srcPath = srcURL.Path
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/yml/thumbnailer"
+)
+
+// authKey is an API key of the -api-keys file. Its scopes are the endpoints
+// it may call, the sources it may read and the destinations it may write,
+// as URL or path prefixes. An empty scope allows everything.
+type authKey struct {
+	// SHA256 is the hex encoded SHA-256 of the key, the keys themselves
+	// are not stored.
+	SHA256       string   `json:"sha256"`
+	Endpoints    []string `json:"endpoints,omitempty"`
+	Sources      []string `json:"sources,omitempty"`
+	Destinations []string `json:"destinations,omitempty"`
+
+	name string
+}
+
+// readAPIKeys reads the API keys from the JSON file filename, an object
+// mapping the key names to their authKey:
+//
+//	{"ci": {"sha256": "<sha256 of the key>", "endpoints": ["/thumbs/", "/jobs"], "destinations": ["s3://thumbs/ci/"]}}
+//
+// The keys are returned by their SHA256.
+func readAPIKeys(filename string) (map[string]*authKey, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var named map[string]*authKey
+	if err := json.Unmarshal(data, &named); err != nil {
+		return nil, fmt.Errorf("An error occured while parsing the API keys %s: %w", filename, err)
+	}
+	keys := make(map[string]*authKey, len(named))
+	for name, key := range named {
+		if key == nil {
+			return nil, fmt.Errorf("%s: the API key %q is empty", filename, name)
+		}
+		key.name = name
+		key.SHA256 = strings.ToLower(key.SHA256)
+		if sum, err := hex.DecodeString(key.SHA256); err != nil || len(sum) != sha256.Size {
+			return nil, fmt.Errorf("%s: invalid sha256 for the API key %q", filename, name)
+		}
+		if other, ok := keys[key.SHA256]; ok {
+			return nil, fmt.Errorf("%s: the API keys %q and %q are the same", filename, other.name, name)
+		}
+		for _, endpoint := range key.Endpoints {
+			if !strings.HasPrefix(endpoint, "/") {
+				return nil, fmt.Errorf("%s: unsupported endpoint %q for the API key %q", filename, endpoint, name)
+			}
+		}
+		for _, prefixes := range [][]string{key.Sources, key.Destinations} {
+			for i, prefix := range prefixes {
+				u, ok := normalizeURL(prefix)
+				if !ok {
+					return nil, fmt.Errorf("%s: invalid prefix %q for the API key %q", filename, prefix, name)
+				}
+				prefixes[i] = u
+			}
+		}
+		keys[key.SHA256] = key
+	}
+	return keys, nil
+}
+
+// errNotAllowed is wrapped by the errors of the requests out of the scope of
+// their key.
+var errNotAllowed = errors.New("not allowed")
+
+type authKeyContext struct{}
+
+// authenticate wraps h, when the server has API keys the requests without a
+// known key are refused with 401 Unauthorized and those to an endpoint out of
+// the scope of their key with 403 Forbidden. The key is available to h with
+// keyOf.
+func authenticate(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		keys := currentServer().apiKeys
+		if keys == nil {
+			h(w, r)
+			return
+		}
+		key := lookupKey(r, keys)
+		if key == nil {
+			log.Println("audit: unauthenticated request from", r.RemoteAddr, r.Method, r.URL.Path)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="thumbnailer"`)
+			http.Error(w, "A valid API key is required", http.StatusUnauthorized)
+			return
+		}
+		if !hasPrefix(r.URL.Path, key.Endpoints) {
+			forbidden(w, r, key, fmt.Errorf("The endpoint %s is not allowed", r.URL.Path))
+			return
+		}
+		h(w, r.WithContext(context.WithValue(r.Context(), authKeyContext{}, key)))
+	}
+}
+
+// lookupKey returns the key of keys sent with r, nil when it is unknown.
+func lookupKey(r *http.Request, keys map[string]*authKey) *authKey {
+	if keys == nil {
+		return nil
+	}
+	sum := sha256.Sum256([]byte(apiKey(r)))
+	return keys[hex.EncodeToString(sum[:])]
+}
+
+// keyOf returns the API key of r, nil when the server has no API keys.
+func keyOf(r *http.Request) *authKey {
+	key, _ := r.Context().Value(authKeyContext{}).(*authKey)
+	return key
+}
+
+// forbidden refuses r, out of the scope of key, with 403 Forbidden.
+func forbidden(w http.ResponseWriter, r *http.Request, key *authKey, err error) {
+	log.Println("audit: key", key.Name(), "forbidden", r.Method, r.URL.Path, err)
+	http.Error(w, err.Error(), http.StatusForbidden)
+}
+
+// Name returns the name of the key, empty for a nil key.
+func (k *authKey) Name() string {
+	if k == nil {
+		return ""
+	}
+	return k.name
+}
+
+// allowSource checks that the key may read the source image src, a nil key
+// may read everything.
+func (k *authKey) allowSource(src string) error {
+	if k != nil && !within(src, k.Sources) {
+		return fmt.Errorf("The source %s is %w", src, errNotAllowed)
+	}
+	return nil
+}
+
+// allowDestinations checks that the key may save the thumbnails of tm, a nil
+// key may save them everywhere. The folders are checked first, the URLs of
+// the thumbnails, which depend on the name template and on the source, are
+// checked by tm.AllowDestination once they are named.
+func (k *authKey) allowDestinations(tm *thumbnailer.ThumbnailerMessage) error {
+	if k == nil || len(k.Destinations) == 0 {
+		return nil
+	}
+	for _, dst := range tm.Destinations() {
+		if !within(dst, k.Destinations) {
+			return fmt.Errorf("The destination %s is %w", dst, errNotAllowed)
+		}
+	}
+	tm.AllowDestination = k.allowDestination
+	return nil
+}
+
+// allowDestination checks that the key may save the thumbnail thumbURL.
+func (k *authKey) allowDestination(thumbURL *url.URL) error {
+	if !within(thumbURL.String(), k.Destinations) {
+		log.Println("audit: key", k.name, "forbidden destination", thumbURL)
+		return fmt.Errorf("The destination %s is %w", thumbURL, errNotAllowed)
+	}
+	return nil
+}
+
+// authorize checks that the key may read the source and save the
+// thumbnails of tm.
+func (k *authKey) authorize(tm *thumbnailer.ThumbnailerMessage) error {
+	if err := k.allowSource(tm.SrcImage); err != nil {
+		return err
+	}
+	return k.allowDestinations(tm)
+}
+
+// hasPrefix tells if s starts with one of the prefixes, or if there are no
+// prefixes.
+func hasPrefix(s string, prefixes []string) bool {
+	if len(prefixes) == 0 {
+		return true
+	}
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(s, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeURL returns rawURL as formatted by net/url, with "//" after its
+// scheme. ok is false when it is invalid or has "." or ".." segments, which
+// could escape a prefix.
+func normalizeURL(rawURL string) (string, bool) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", false
+	}
+	for _, segment := range strings.Split(u.Path, "/") {
+		if segment == "." || segment == ".." {
+			return "", false
+		}
+	}
+	// file:/tmp and file:///tmp are the same URL
+	u.OmitHost = false
+	return u.String(), true
+}
+
+// within tells if the URL rawURL starts with one of the prefixes, or if
+// there are no prefixes.
+func within(rawURL string, prefixes []string) bool {
+	if len(prefixes) == 0 {
+		return true
+	}
+	u, ok := normalizeURL(rawURL)
+	return ok && hasPrefix(u, prefixes)
+}
+
+// audit logs the thumbnails of src generated, during action, with the
+// API key named key. Nothing is logged without API keys.
+func audit(key, action, src string, results []thumbnailer.CallbackResult) {
+	if key == "" {
+		return
+	}
+	thumbs := make([]string, 0, len(results))
+	for _, r := range results {
+		if r.Error == "" && !r.Skipped {
+			thumbs = append(thumbs, r.Thumbnail)
+		}
+	}
+	log.Println("audit: key", key, action, "src", src, "thumbnails", thumbs)
+}
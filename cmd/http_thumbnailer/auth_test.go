@@ -0,0 +1,84 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/yml/thumbnailer"
+)
+
+func Test_authenticate(t *testing.T) {
+	URLNames["/thumbs/"] = "/thumbs/"
+	m := thumbnailer.NewMemStorage()
+	srv := testServer(t, m, nil)
+	srv.apiKeys = testKeys([]string{"/thumbs/"}, "a")
+	for _, k := range srv.apiKeys {
+		k.Sources = []string{"mem://src/"}
+	}
+	current.Store(srv)
+	post := func(path, key, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", path, strings.NewReader(body))
+		if key != "" {
+			r.Header.Set("X-API-Key", key)
+		}
+		w := httptest.NewRecorder()
+		authenticate(ThumbsHandler)(w, r)
+		return w
+	}
+	request := `{"srcImage": "mem://src/pic.jpg", "dstFolder": "mem://dst/", "opts": [{"width": 100}]}`
+
+	for _, key := range []string{"", "unknown"} {
+		w := post("/thumbs/", key, request)
+		if w.Code != http.StatusUnauthorized || w.Header().Get("WWW-Authenticate") == "" {
+			t.Fatalf("key %q: got %d, WWW-Authenticate: %q, expected 401", key, w.Code, w.Header().Get("WWW-Authenticate"))
+		}
+	}
+	if w := post("/jobs", "a", request); w.Code != http.StatusForbidden {
+		t.Fatalf("expected the endpoint out of the scope of the key to be forbidden, got %d", w.Code)
+	}
+	m.Put("other/pic.jpg", []byte("x"))
+	if w := post("/thumbs/", "a", strings.Replace(request, "mem://src/", "mem://other/", 1)); w.Code != http.StatusForbidden {
+		t.Fatalf("expected the source out of the scope of the key to be forbidden, got %d", w.Code)
+	}
+	if w := post("/thumbs/", "a", request); w.Code != http.StatusOK {
+		t.Fatalf("got %d %s, expected 200", w.Code, w.Body)
+	}
+	if _, ok := m.Bytes("dst/pic_s100x75.jpg"); !ok {
+		t.Fatal("expected the thumbnail to be saved")
+	}
+}
+
+func Test_readAPIKeys(t *testing.T) {
+	dir := t.TempDir()
+	for content, ok := range map[string]bool{
+		`{"a": {"sha256": "` + strings.Repeat("AB", 32) + `", "endpoints": ["/thumbs/"], "sources": ["s3://bucket/"]}}`: true,
+		`{"a": {"sha256": "abc"}}`: false,
+		`{"a": null}`:              false,
+		`{"a": {"sha256": "` + strings.Repeat("ab", 32) + `", "endpoints": ["thumbs"]}}`:                             false,
+		`{"a": {"sha256": "` + strings.Repeat("ab", 32) + `", "destinations": ["s3://bucket/../other/"]}}`:           false,
+		`{"a": {"sha256": "` + strings.Repeat("ab", 32) + `"}, "b": {"sha256": "` + strings.Repeat("AB", 32) + `"}}`: false,
+	} {
+		filename := filepath.Join(dir, "keys.json")
+		if err := ioutil.WriteFile(filename, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		keys, err := readAPIKeys(filename)
+		if (err == nil) != ok {
+			t.Fatalf("%s: got %v, expected ok: %v", content, err, ok)
+		}
+		if ok {
+			key := keys[strings.Repeat("ab", 32)]
+			if key == nil || key.Name() != "a" {
+				t.Fatalf("expected the key a by its lower case sha256, got %v", keys)
+			}
+		}
+	}
+	if _, err := readAPIKeys(filepath.Join(dir, "missing.json")); !os.IsNotExist(err) {
+		t.Fatalf("got: %v, expected a missing file", err)
+	}
+}
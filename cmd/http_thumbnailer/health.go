@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/yml/thumbnailer"
+)
+
+// readiness is the body of /readyz, checks maps each check to "ok", to
+// "unchecked" for the storages which can't be checked or to the reason it
+// failed.
+type readiness struct {
+	Ready  bool              `json:"ready"`
+	Checks map[string]string `json:"checks"`
+}
+
+// HealthzHandler tells that the process is alive.
+func HealthzHandler(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("ok\n"))
+}
+
+// ReadyzHandler tells if the server can take more requests: the storages of
+// its folders are reachable, not all the workers are busy and the job queue
+// is not full. It answers 503 Service Unavailable otherwise.
+func ReadyzHandler(w http.ResponseWriter, r *http.Request) {
+	srv := currentServer()
+	rd := readiness{Ready: true, Checks: map[string]string{}}
+	check := func(name string, err error) {
+		if err != nil {
+			rd.Ready = false
+			rd.Checks[name] = err.Error()
+			return
+		}
+		rd.Checks[name] = "ok"
+	}
+	for _, folder := range []string{srv.srcFolder, srv.dstFolder, srv.uploadFolder} {
+		if folder != "" {
+			err := checkStorage(srv.thumbs, folder, srv.readyTimeout)
+			if errors.Is(err, thumbnailer.ErrStorageUnchecked) {
+				rd.Checks["storage "+folder] = "unchecked"
+				continue
+			}
+			check("storage "+folder, err)
+		}
+	}
+	if busy, capacity := srv.thumbs.Load(); capacity > 0 && busy >= capacity {
+		check("workers", fmt.Errorf("%d/%d workers busy", busy, capacity))
+	} else {
+		check("workers", nil)
+	}
+	if queued, capacity := jobs.Len(); queued >= capacity {
+		check("jobs", fmt.Errorf("%d/%d jobs queued", queued, capacity))
+	} else {
+		check("jobs", nil)
+	}
+	status := http.StatusOK
+	if !rd.Ready {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, rd, status)
+}
+
+// checkStorage checks the storage of folder within timeout.
+func checkStorage(thumbs *thumbnailer.Thumbnailer, folder string, timeout time.Duration) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- thumbs.CheckStorage(folder)
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(timeout):
+		return fmt.Errorf("No answer within %s", timeout)
+	}
+}
+
+// VersionHandler returns the build information of the server.
+func VersionHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, currentServer().thumbs.BuildInfo(), http.StatusOK)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}, status int) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(body)
+}
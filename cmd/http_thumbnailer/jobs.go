@@ -0,0 +1,214 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/yml/thumbnailer"
+)
+
+// Status of the jobs.
+const (
+	jobQueued  = "queued"
+	jobRunning = "running"
+	jobDone    = "done"
+	jobFailed  = "failed"
+)
+
+var errQueueFull = errors.New("The job queue is full")
+
+// Job is a ThumbnailerMessage processed asynchronously.
+type Job struct {
+	ID          string                       `json:"id"`
+	Status      string                       `json:"status"`
+	Created     time.Time                    `json:"created"`
+	Finished    *time.Time                   `json:"finished,omitempty"`
+	Results     []thumbnailer.CallbackResult `json:"results,omitempty"`
+	Error       string                       `json:"error,omitempty"`
+	CallbackURL string                       `json:"callbackURL,omitempty"`
+
+	msg thumbnailer.ThumbnailerMessage
+	// key is the name of the API key which submitted the job.
+	key string
+}
+
+// JobQueue processes the jobs with a pool of workers. The finished jobs are
+// kept for retention, and at most maxJobs of them are kept. A finished job is
+// posted to its CallbackURL, in place of the Callback of its message.
+type JobQueue struct {
+	thumbs    func() *thumbnailer.Thumbnailer
+	queue     chan *Job
+	retention time.Duration
+	maxJobs   int
+
+	mu   sync.Mutex
+	jobs map[string]*Job
+	// finished are the IDs of the finished jobs, the oldest first.
+	finished []string
+}
+
+// NewJobQueue returns a JobQueue processing its jobs in workers goroutines
+// with the Thumbnailer returned by thumbs when they start, at most queueSize
+// jobs wait for a worker.
+func NewJobQueue(thumbs func() *thumbnailer.Thumbnailer, workers, queueSize int, retention time.Duration, maxJobs int) *JobQueue {
+	q := &JobQueue{
+		thumbs:    thumbs,
+		queue:     make(chan *Job, queueSize),
+		retention: retention,
+		maxJobs:   maxJobs,
+		jobs:      map[string]*Job{},
+	}
+	for i := 0; i < workers; i++ {
+		go q.work()
+	}
+	return q
+}
+
+// Submit queues a job processing tm, submitted with the API key named key.
+func (q *JobQueue) Submit(tm thumbnailer.ThumbnailerMessage, key string) (Job, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return Job{}, err
+	}
+	job := &Job{
+		ID:          hex.EncodeToString(id),
+		Status:      jobQueued,
+		Created:     time.Now(),
+		CallbackURL: tm.CallbackURL,
+		msg:         tm,
+		key:         key,
+	}
+	job.msg.CallbackURL = ""
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	select {
+	case q.queue <- job:
+	default:
+		return Job{}, errQueueFull
+	}
+	q.jobs[job.ID] = job
+	return *job, nil
+}
+
+// Get returns the job id.
+func (q *JobQueue) Get(id string) (Job, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	job, ok := q.jobs[id]
+	if !ok {
+		return Job{}, false
+	}
+	return *job, true
+}
+
+// Len returns the number of jobs waiting for a worker and the maximum.
+func (q *JobQueue) Len() (queued, capacity int) {
+	return len(q.queue), cap(q.queue)
+}
+
+func (q *JobQueue) work() {
+	for job := range q.queue {
+		q.mu.Lock()
+		job.Status = jobRunning
+		q.mu.Unlock()
+
+		thumbs := q.thumbs()
+		results, err := thumbs.Process(&job.msg)
+
+		q.mu.Lock()
+		now := time.Now()
+		job.Finished = &now
+		job.Results = thumbnailer.CallbackResults(results)
+		job.Status = jobDone
+		if err != nil {
+			job.Status = jobFailed
+			job.Error = err.Error()
+		}
+		q.finished = append(q.finished, job.ID)
+		q.prune()
+		finished := *job
+		q.mu.Unlock()
+
+		audit(finished.key, "job "+finished.ID, finished.msg.SrcImage, finished.Results)
+
+		if finished.CallbackURL != "" {
+			go notify(thumbs, finished)
+		}
+	}
+}
+
+// prune forgets the finished jobs older than the retention, or in excess.
+func (q *JobQueue) prune() {
+	n := 0
+	for _, id := range q.finished {
+		job := q.jobs[id]
+		if len(q.finished)-n <= q.maxJobs && time.Since(*job.Finished) <= q.retention {
+			break
+		}
+		delete(q.jobs, id)
+		n++
+	}
+	q.finished = q.finished[n:]
+}
+
+// notify posts job to its CallbackURL.
+func notify(thumbs *thumbnailer.Thumbnailer, job Job) {
+	if err := thumbs.Notify(job.CallbackURL, job); err != nil {
+		log.Println("An error occured while posting the job", job.ID, "to", job.CallbackURL, err)
+	}
+}
+
+// JobsHandler is the http endpoint of the asynchronous jobs:
+// * POST /jobs with a json thumbnail request, optionally with a "callbackURL"
+// * GET /jobs/<id> returns the status and the results of a job
+func JobsHandler(w http.ResponseWriter, r *http.Request) {
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, URLNames["/jobs/"]), "/")
+	switch {
+	case r.Method == "POST" && (id == "" || r.URL.Path == "/jobs"):
+		srv := currentServer()
+		r.Body = http.MaxBytesReader(w, r.Body, srv.maxBodySize)
+		defer r.Body.Close()
+		var tm thumbnailer.ThumbnailerMessage
+		if err := json.NewDecoder(r.Body).Decode(&tm); err != nil {
+			http.Error(w, fmt.Sprintf("ERROR: failed to unmarshal the job request - %s", err), bodyStatus(err))
+			return
+		}
+		if err := srv.thumbs.Validate(&tm); err != nil {
+			http.Error(w, err.Error(), validationStatus(err))
+			return
+		}
+		key := keyOf(r)
+		if err := key.authorize(&tm); err != nil {
+			forbidden(w, r, key, err)
+			return
+		}
+		job, err := jobs.Submit(tm, key.Name())
+		if err == errQueueFull {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Location", URLNames["/jobs/"]+job.ID)
+		writeJSON(w, job, http.StatusAccepted)
+	case r.Method == "GET" && id != "":
+		job, ok := jobs.Get(id)
+		// The jobs of the other API keys are not disclosed
+		if !ok || job.key != keyOf(r).Name() {
+			http.Error(w, fmt.Sprintf("Job not found: %s", id), http.StatusNotFound)
+			return
+		}
+		writeJSON(w, job, http.StatusOK)
+	default:
+		http.Error(w, fmt.Sprintf("Request method not supported: %s", r.Method), http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"image"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/yml/thumbnailer"
+)
+
+// blockingImageOpenSaver waits for release before saving its image.
+type blockingImageOpenSaver struct {
+	thumbnailer.ImageOpenSaver
+	release chan struct{}
+}
+
+func (s blockingImageOpenSaver) Save(img image.Image) error {
+	<-s.release
+	return s.ImageOpenSaver.Save(img)
+}
+
+// testServer returns a server reading and saving the images of m with the
+// mem:// scheme, with the block:// scheme the images are saved to m once
+// release is closed. testdata/pic.jpg is stored as mem://src/pic.jpg.
+func testServer(t *testing.T, m *thumbnailer.MemStorage, release chan struct{}) *server {
+	data, err := ioutil.ReadFile(filepath.Join("..", "..", "testdata", "pic.jpg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Put("src/pic.jpg", data)
+	thumbs := thumbnailer.New(
+		thumbnailer.WithStorage("mem", m.Storage),
+		thumbnailer.WithStorage("block", func(u *url.URL, c *thumbnailer.Codec) (thumbnailer.ImageOpenSaver, error) {
+			s, err := m.Storage(u, c)
+			return blockingImageOpenSaver{s, release}, err
+		}),
+	)
+	return &server{
+		thumbs:        thumbs,
+		uploadThumbs:  thumbs.Clone(thumbnailer.WithStorage("upload", uploads.Storage)),
+		uploadMaxSize: 1 << 20,
+		maxBodySize:   1 << 20,
+		rateLimitBy:   rateByIP,
+	}
+}
+
+// submitJob posts the job request body with the API key key.
+func submitJob(t *testing.T, body, key string) Job {
+	r := httptest.NewRequest("POST", "/jobs", strings.NewReader(body))
+	r.Header.Set("Authorization", "Bearer "+key)
+	w := httptest.NewRecorder()
+	authenticate(JobsHandler)(w, r)
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("got %d %s, expected 202", w.Code, w.Body)
+	}
+	var job Job
+	if err := json.NewDecoder(w.Body).Decode(&job); err != nil {
+		t.Fatal(err)
+	}
+	if w.Header().Get("Location") != "/jobs/"+job.ID {
+		t.Fatalf("unexpected Location %q for the job %s", w.Header().Get("Location"), job.ID)
+	}
+	return job
+}
+
+// getJob returns the status code of GET /jobs/<id> with the API key key,
+// and the job.
+func getJob(t *testing.T, id, key string) (int, Job) {
+	r := httptest.NewRequest("GET", "/jobs/"+id, nil)
+	r.Header.Set("Authorization", "Bearer "+key)
+	w := httptest.NewRecorder()
+	authenticate(JobsHandler)(w, r)
+	var job Job
+	if w.Code == http.StatusOK {
+		if err := json.NewDecoder(w.Body).Decode(&job); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return w.Code, job
+}
+
+// waitJob waits for the job id to have the status.
+func waitJob(t *testing.T, id, key, status string) Job {
+	for deadline := time.Now().Add(10 * time.Second); ; {
+		_, job := getJob(t, id, key)
+		if job.Status == status {
+			return job
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the job %s to be %s, got %q", id, status, job.Status)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func Test_JobsHandler(t *testing.T) {
+	URLNames["/jobs/"] = "/jobs/"
+	m := thumbnailer.NewMemStorage()
+	release := make(chan struct{})
+	srv := testServer(t, m, release)
+	srv.apiKeys = testKeys(nil, "a", "b")
+	current.Store(srv)
+	jobs = NewJobQueue(func() *thumbnailer.Thumbnailer { return currentServer().thumbs }, 1, 10, time.Hour, 10)
+
+	// The first job takes the only worker until release is closed
+	first := submitJob(t, `{"srcImage": "mem://src/pic.jpg", "dstFolder": "block://dst", "opts": [{"width": 100}]}`, "a")
+	if first.Status != jobQueued {
+		t.Fatalf("got: %q, expected: %q", first.Status, jobQueued)
+	}
+	waitJob(t, first.ID, "a", jobRunning)
+	second := submitJob(t, `{"srcImage": "mem://src/missing.jpg", "dstFolder": "mem://dst", "opts": [{"width": 100}]}`, "a")
+	if _, job := getJob(t, second.ID, "a"); job.Status != jobQueued {
+		t.Fatalf("expected the second job to wait for the worker, got %q", job.Status)
+	}
+	// The jobs of the other keys are not disclosed
+	if code, _ := getJob(t, first.ID, "b"); code != http.StatusNotFound {
+		t.Fatalf("got: %d, expected: 404", code)
+	}
+
+	close(release)
+	job := waitJob(t, first.ID, "a", jobDone)
+	if job.Finished == nil || len(job.Results) != 1 || job.Results[0].Thumbnail != "block://dst/pic_s100x75.jpg" || job.Results[0].Error != "" {
+		t.Fatalf("unexpected job %+v", job)
+	}
+	if _, ok := m.Bytes("dst/pic_s100x75.jpg"); !ok {
+		t.Fatal("expected the thumbnail to be saved")
+	}
+	job = waitJob(t, second.ID, "a", jobFailed)
+	if job.Error == "" {
+		t.Fatalf("expected the error of the failed job, got %+v", job)
+	}
+	if code, _ := getJob(t, "unknown", "a"); code != http.StatusNotFound {
+		t.Fatalf("got: %d, expected: 404", code)
+	}
+}
@@ -2,77 +2,123 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
+	"expvar"
 	"flag"
 	"fmt"
+	"image"
 	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"os"
 	"path/filepath"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/yml/thumbnailer"
+	"github.com/yml/thumbnailer/config"
 )
 
 var (
-	addr      = flag.String("addr", "127.0.0.1:9900", "http addr (default is 127.0.0.1:9900)")
-	srcFolder = flag.String("srcFolder", "", "Source folder including the scheme (file:///tmp/my.jpg)")
-	dstFolder = flag.String("dstFolder", "", "Destination folder including the scheme (file:///tmp/my.jpg)")
-	URLNames  = make(map[string]string)
+	addr             = flag.String("addr", "127.0.0.1:9900", "http addr (default is 127.0.0.1:9900)")
+	srcFolder        = flag.String("srcFolder", "", "Source folder including the scheme (file:///tmp/my.jpg)")
+	dstFolder        = flag.String("dstFolder", "", "Destination folder including the scheme (file:///tmp/my.jpg)")
+	workers          = flag.Int("workers", 0, "Maximum number of thumbnails generated concurrently (default is no limit)")
+	filter           = flag.String("filter", string(thumbnailer.DefaultFilter), "Default resampling filter (lanczos, catmullrom, linear, box, nearestneighbor, mitchellnetravali)")
+	fileMode         = flag.String("file-mode", "0644", "Permissions of the thumbnails saved with the file:// scheme")
+	dirMode          = flag.String("dir-mode", "0755", "Permissions of the directories created with the file:// scheme")
+	s3ACL            = flag.String("s3-acl", "public-read", "Canned ACL of the thumbnails uploaded to S3")
+	s3CacheControl   = flag.String("s3-cache-control", "", "Cache-Control header of the thumbnails uploaded to S3")
+	s3StorageClass   = flag.String("s3-storage-class", "", "Storage class of the thumbnails uploaded to S3")
+	s3SSE            = flag.String("s3-sse", "", "Server side encryption of the thumbnails uploaded to S3 (AES256, aws:kms)")
+	retries          = flag.Int("retries", thumbnailer.DefaultRetryPolicy.MaxAttempts-1, "Number of retries of the failed storage operations")
+	retryDelay       = flag.Duration("retry-delay", thumbnailer.DefaultRetryPolicy.BaseDelay, "Delay before the first retry, doubled after each retry")
+	retryMaxDelay    = flag.Duration("retry-max-delay", thumbnailer.DefaultRetryPolicy.MaxDelay, "Maximum delay between two retries")
+	retryTimeout     = flag.Duration("retry-timeout", thumbnailer.DefaultRetryPolicy.Timeout, "Maximum time spent on a storage operation, retries included")
+	breakerThreshold = flag.Int("breaker-threshold", thumbnailer.DefaultRetryPolicy.BreakerThreshold, "Consecutive failures opening the circuit breaker of a host or bucket (0 disables it)")
+	breakerCooldown  = flag.Duration("breaker-cooldown", thumbnailer.DefaultRetryPolicy.BreakerCooldown, "Time the circuit breaker stays open")
+	sourceCacheDir   = flag.String("source-cache-dir", "", "Directory caching the S3 source images (disabled when empty)")
+	sourceCacheSize  = flag.Int64("source-cache-size", 1<<30, "Maximum size in bytes of the source cache")
+	sourceCacheTTL   = flag.Duration("source-cache-ttl", 24*time.Hour, "Time the source images are kept in the cache")
+	decodedCacheSize = flag.Int64("decoded-cache-size", 256<<20, "Maximum size in bytes of the decoded source images kept in memory (0 disables the cache)")
+	decodedCacheDim  = flag.Int("decoded-cache-dim", 2048, "Minimum width and height of the source images kept in memory, they are downscaled on decode (0 keeps the full size)")
+	nameTemplate     = flag.String("name-template", thumbnailer.DefaultNameTemplate, "Template, or preset name (default, folder, hashed, content), used to name the thumbnails")
+	s3AccessKey      = flag.String("s3-access-key", "", "S3 access key (AWS_ACCESS_KEY_ID is used when empty)")
+	s3SecretKey      = flag.String("s3-secret-key", "", "S3 secret key (AWS_SECRET_ACCESS_KEY is used when empty)")
+	s3Region         = flag.String("s3-region", "us-east-1", "S3 region, the regions requiring the AWS signature version 4 (eu-central-1...) are not supported")
+	maxOpts          = flag.Int("max-opts", 0, "Maximum number of opts of a request (0 means no limit)")
+	maxWidth         = flag.Int("max-width", 0, "Maximum width of a thumbnail (0 means no limit)")
+	maxHeight        = flag.Int("max-height", 0, "Maximum height of a thumbnail (0 means no limit)")
+	logFile          = flag.String("log-file", "", "File the logs are appended to (stderr when empty)")
+	metricsAddr      = flag.String("metrics-addr", "", "Address serving the expvar metrics on /debug/vars (disabled when empty)")
+	presetsFile      = flag.String("presets", "", "JSON file of the named thumbnail presets, e.g. {\"avatar\": {\"width\": 64, \"height\": 64}}")
+	callbackSecret   = flag.String("callback-secret", "", "Secret signing the callback requests with HMAC-SHA256 (unsigned when empty)")
+	callbackTimeout  = flag.Duration("callback-timeout", thumbnailer.DefaultCallbackTimeout, "Timeout of each callback request")
+	callbackRetries  = flag.Int("callback-retries", thumbnailer.DefaultRetryPolicy.MaxAttempts-1, "Number of retries of the failed callback requests")
+	jobWorkers       = flag.Int("job-workers", 4, "Number of workers processing the asynchronous jobs")
+	jobQueueSize     = flag.Int("job-queue", 100, "Maximum number of asynchronous jobs waiting for a worker")
+	jobRetention     = flag.Duration("job-retention", time.Hour, "Time the finished asynchronous jobs are kept")
+	jobMax           = flag.Int("job-max", 1000, "Maximum number of finished asynchronous jobs kept")
+	uploadFolder     = flag.String("upload-folder", "", "Folder including the scheme the uploaded images are saved to (not saved when empty)")
+	uploadMaxSize    = flag.Int64("upload-max-size", 32<<20, "Maximum size in bytes of an upload request")
+	readyTimeout     = flag.Duration("ready-timeout", 5*time.Second, "Maximum time /readyz waits for a storage to answer")
+	maxBodySize      = flag.Int64("max-body-size", 1<<20, "Maximum size in bytes of a json thumbnail request")
+	rateLimit        = flag.Float64("rate-limit", 0, "Requests per second allowed to each client (0 means no limit)")
+	rateBurst        = flag.Int("rate-burst", 10, "Requests a client can send at once above -rate-limit")
+	rateLimitBy      = flag.String("rate-limit-by", rateByIP, "Identity of the rate limited clients: ip, or api-key for the name of the API key of -api-keys")
+	apiKeysFile      = flag.String("api-keys", "", "JSON file of the API keys, stored as their SHA-256, required by the thumbnail endpoints (no authentication when empty)")
+	configPoll       = flag.Duration("config-poll", 0, "Interval the configuration file is checked for changes at, it is reloaded when modified (0 only reloads on SIGHUP)")
+	URLNames         = make(map[string]string)
+	jobs             *JobQueue
 )
 
-func processThumbResults(tm thumbnailer.ThumbnailerMessage) ([]thumbnailer.ThumbnailResult, error) {
-	resultChan := tm.GenerateThumbnails()
-	results := make([]thumbnailer.ThumbnailResult, 0)
-	for result := range resultChan {
-		results = append(results, result)
-	}
-
-	for _, result := range results {
-		if result.Err != nil {
-			err := fmt.Errorf("Error: At least one thumb generation failed - %s", result.Err, results)
-			return results, err
-		}
-	}
-
-	if tm.DeleteSrc == true {
-		log.Println("Deleting", tm.SrcImage)
-		err := tm.DeleteImage()
-		if err != nil {
-			return results, err
-		}
-	}
-	return results, nil
-
-}
-
 // ThumbHandler is an http endpoint that generate the requested thumb when it receives a GET request :
 // * 50x50/my-picture.jpg
+// * avatar/my-picture.jpg, avatar being the name of a preset
 func ThumbHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method == "GET" {
 		var width, height int
 		var filename string
 		path := strings.TrimPrefix(r.URL.Path, URLNames["/thumb/"])
-		fmt.Sscanf(path, "%dx%d/%s", &width, &height, &filename)
-		fmt.Printf("[DEBUG] width: %d , height: %d, filename: %s ", width, height, filename)
-		opt := thumbnailer.ThumbnailOpt{
-			Width:  width,
-			Height: height,
+		srv := currentServer()
+		tm := thumbnailer.ThumbnailerMessage{}
+		if n, _ := fmt.Sscanf(path, "%dx%d/%s", &width, &height, &filename); n == 3 {
+			fmt.Printf("[DEBUG] width: %d , height: %d, filename: %s ", width, height, filename)
+			tm.Opts = append(tm.Opts, thumbnailer.ThumbnailOpt{
+				Width:  width,
+				Height: height,
+			})
+		} else if i := strings.Index(path, "/"); i > 0 {
+			tm.Presets = []string{path[:i]}
+			filename = path[i+1:]
+		} else {
+			http.Error(w, fmt.Sprintf("Unsupported thumb path: %s", path), http.StatusBadRequest)
+			return
 		}
 		// build the thumbReg and generate the thumb and return it or redirect
-		tm := thumbnailer.ThumbnailerMessage{}
 		// TODO (yml) generalized this approach to support other scheme
 		// Assume file:// to start
 		// there is security implication that need to be verified here.
-		tm.SrcImage = filepath.Join(*srcFolder, filename)
-		tm.DstFolder = *dstFolder
-		tm.Opts = append(tm.Opts, opt)
-		results, err := processThumbResults(tm)
+		tm.SrcImage = filepath.Join(srv.srcFolder, filename)
+		tm.DstFolder = srv.dstFolder
+		if err := srv.thumbs.Validate(&tm); err != nil {
+			http.Error(w, err.Error(), validationStatus(err))
+			return
+		}
+		key := keyOf(r)
+		if err := key.authorize(&tm); err != nil {
+			forbidden(w, r, key, err)
+			return
+		}
+		results, err := srv.thumbs.Process(&tm)
+		audit(key.Name(), r.Method+" "+r.URL.Path, tm.SrcImage, thumbnailer.CallbackResults(results))
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			http.Error(w, err.Error(), processStatus(err))
 			return
 		}
 
@@ -96,10 +142,15 @@ func ThumbHandler(w http.ResponseWriter, r *http.Request) {
 // curl 127.0.0.1:9900/thumbs/ -d '{"srcImage": "s3://nsq-thumb-src-test/baignade.jpg", "opts": [{"width":0, "height":350}], "dstFolder":"s3://nsq-thumb-dst-test/"}']
 func ThumbsHandler(w http.ResponseWriter, r *http.Request) {
 	var thumbReq bytes.Buffer
+	srv := currentServer()
 	if r.Method == "GET" {
 		// In this case we are going to look for the thumbReq in the URL.
 		// It should be base 64 encoded
 		path := strings.TrimPrefix(r.URL.Path, URLNames["/thumbs/"])
+		if int64(base64.URLEncoding.DecodedLen(len(path))) > srv.maxBodySize {
+			http.Error(w, fmt.Sprintf("The thumb generation request exceeds %d bytes", srv.maxBodySize), http.StatusRequestEntityTooLarge)
+			return
+		}
 		_, err := io.Copy(&thumbReq, base64.NewDecoder(base64.URLEncoding, strings.NewReader(path)))
 		if err != nil {
 			http.Error(w, fmt.Sprintf("failed to decode the thumb generation request: %s", err), http.StatusBadRequest)
@@ -107,10 +158,11 @@ func ThumbsHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	} else if r.Method == "POST" {
 		// Grab the JSON representation of thumbReq directly from the r.Body
+		r.Body = http.MaxBytesReader(w, r.Body, srv.maxBodySize)
 		_, err := io.Copy(&thumbReq, r.Body)
 		defer r.Body.Close()
 		if err != nil {
-			http.Error(w, fmt.Sprintf("failed to decode the thumb generation request: %s", err), http.StatusBadRequest)
+			http.Error(w, fmt.Sprintf("failed to decode the thumb generation request: %s", err), bodyStatus(err))
 			return
 		}
 	} else {
@@ -126,10 +178,20 @@ func ThumbsHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	if err := srv.thumbs.Validate(&tm); err != nil {
+		http.Error(w, err.Error(), validationStatus(err))
+		return
+	}
+	key := keyOf(r)
+	if err := key.authorize(&tm); err != nil {
+		forbidden(w, r, key, err)
+		return
+	}
 
-	results, err := processThumbResults(tm)
+	results, err := srv.thumbs.Process(&tm)
+	audit(key.Name(), r.Method+" "+URLNames["/thumbs/"], tm.SrcImage, thumbnailer.CallbackResults(results))
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), processStatus(err))
 		return
 	}
 
@@ -144,11 +206,13 @@ func ThumbsHandler(w http.ResponseWriter, r *http.Request) {
 // base64EncodeHandler is used for debugging, it generates the base64encoded string required to test ThumbsHandler
 func base64EncodeHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method == "POST" {
+		r.Body = http.MaxBytesReader(w, r.Body, currentServer().maxBodySize)
 		thumbReq, err := ioutil.ReadAll(r.Body)
 		defer r.Body.Close()
 
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
+			http.Error(w, err.Error(), bodyStatus(err))
+			return
 		}
 
 		w.Write([]byte("\n"))
@@ -161,21 +225,237 @@ func base64EncodeHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// bodyStatus returns the status of the error err reading a request body,
+// 413 Request Entity Too Large when it exceeds its maximum size.
+func bodyStatus(err error) int {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusBadRequest
+}
+
+// validationStatus returns the status of the error err validating a
+// request, 413 Request Entity Too Large when it exceeds the limits.
+func validationStatus(err error) int {
+	if errors.Is(err, thumbnailer.ErrLimitExceeded) {
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusBadRequest
+}
+
+// processStatus returns the status of the error err processing a request,
+// 413 Request Entity Too Large when a resolved thumbnail exceeds the limits
+// and 403 Forbidden when it is out of the scope of the API key.
+func processStatus(err error) int {
+	if errors.Is(err, thumbnailer.ErrLimitExceeded) {
+		return http.StatusRequestEntityTooLarge
+	}
+	if errors.Is(err, errNotAllowed) {
+		return http.StatusForbidden
+	}
+	return http.StatusInternalServerError
+}
+
+// server holds the settings reloaded with the configuration, the requests
+// use the server current when they start.
+type server struct {
+	thumbs *thumbnailer.Thumbnailer
+	// uploadThumbs is thumbs with the upload:// scheme of the uploads.
+	uploadThumbs  *thumbnailer.Thumbnailer
+	srcFolder     string
+	dstFolder     string
+	uploadFolder  string
+	uploadMaxSize int64
+	maxBodySize   int64
+	rateLimit     float64
+	rateBurst     int
+	rateLimitBy   string
+	readyTimeout  time.Duration
+	// apiKeys are the API keys by their SHA-256, nil when the requests are
+	// not authenticated.
+	apiKeys map[string]*authKey
+}
+
+var current atomic.Value
+
+// currentServer returns the server handling the new requests.
+func currentServer() *server {
+	return current.Load().(*server)
+}
+
+// newServer returns a server configured by the flags, the caches are kept
+// across the reloads. The Thumbnailer of prev, when it is set, is cloned:
+// its workers, unless -workers changes, and its thumbnails being generated
+// are shared with the new one. The circuit breakers are reset.
+func newServer(conf *config.Config, logger *log.Logger, diskCache *thumbnailer.DiskCache, sourceCache *thumbnailer.SourceCache, prev *server) (*server, error) {
+	f, err := thumbnailer.ParseFilter(*filter)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := thumbnailer.ParseNameTemplate(*nameTemplate); err != nil {
+		return nil, err
+	}
+	fm, err := thumbnailer.ParseFileMode(*fileMode)
+	if err != nil {
+		return nil, err
+	}
+	dm, err := thumbnailer.ParseFileMode(*dirMode)
+	if err != nil {
+		return nil, err
+	}
+	s3Options := thumbnailer.S3Options{
+		ACL:                  *s3ACL,
+		CacheControl:         *s3CacheControl,
+		StorageClass:         *s3StorageClass,
+		ServerSideEncryption: *s3SSE,
+	}
+	if err := s3Options.Validate(); err != nil {
+		return nil, err
+	}
+	retryPolicy := thumbnailer.RetryPolicy{
+		MaxAttempts:      *retries + 1,
+		BaseDelay:        *retryDelay,
+		MaxDelay:         *retryMaxDelay,
+		Timeout:          *retryTimeout,
+		BreakerThreshold: *breakerThreshold,
+		BreakerCooldown:  *breakerCooldown,
+	}
+	if *rateLimitBy != rateByIP && *rateLimitBy != rateByAPIKey {
+		return nil, fmt.Errorf("Unsupported rate-limit-by value: %q", *rateLimitBy)
+	}
+	var apiKeys map[string]*authKey
+	if *apiKeysFile != "" {
+		apiKeys, err = readAPIKeys(*apiKeysFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	presets := conf.Presets
+	if presets == nil && *presetsFile != "" {
+		presets, err = thumbnailer.ReadPresets(*presetsFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	callbackPolicy := retryPolicy
+	callbackPolicy.MaxAttempts = *callbackRetries + 1
+	s3Base, err := thumbnailer.NewS3Storage(*s3AccessKey, *s3SecretKey, *s3Region, s3Options)
+	if err != nil {
+		return nil, err
+	}
+	s3Storage := thumbnailer.Retry(context.Background(), s3Base, retryPolicy)
+	if diskCache != nil {
+		s3Storage = diskCache.Storage(s3Storage)
+	}
+	options := []thumbnailer.Option{
+		thumbnailer.WithWorkers(*workers),
+		thumbnailer.WithLimits(thumbnailer.Limits{MaxOpts: *maxOpts, MaxWidth: *maxWidth, MaxHeight: *maxHeight}),
+		thumbnailer.WithLogger(logger),
+		thumbnailer.WithSourceCache(sourceCache),
+		thumbnailer.WithFilter(f),
+		thumbnailer.WithNameTemplate(*nameTemplate),
+		thumbnailer.WithStorage("file", thumbnailer.Retry(context.Background(), thumbnailer.FileStorageMode(fm, dm), retryPolicy)),
+		thumbnailer.WithStorage("s3", s3Storage),
+		thumbnailer.WithS3Options(s3Options),
+		thumbnailer.WithPresets(presets),
+		thumbnailer.WithCallbacks(*callbackSecret, *callbackTimeout, callbackPolicy),
+	}
+	var thumbs *thumbnailer.Thumbnailer
+	if prev != nil {
+		thumbs = prev.thumbs.Clone(options...)
+	} else {
+		thumbs = thumbnailer.New(options...)
+	}
+	return &server{
+		thumbs:        thumbs,
+		uploadThumbs:  thumbs.Clone(thumbnailer.WithStorage("upload", uploads.Storage)),
+		srcFolder:     *srcFolder,
+		dstFolder:     *dstFolder,
+		uploadFolder:  *uploadFolder,
+		uploadMaxSize: *uploadMaxSize,
+		maxBodySize:   *maxBodySize,
+		rateLimit:     *rateLimit,
+		rateBurst:     *rateBurst,
+		rateLimitBy:   *rateLimitBy,
+		readyTimeout:  *readyTimeout,
+		apiKeys:       apiKeys,
+	}, nil
+}
+
 func main() {
-	flag.Parse()
+	conf, err := config.Parse(flag.CommandLine, os.Args[1:])
+	if err != nil {
+		log.Fatal(err)
+	}
+	if conf.PrintConfig {
+		conf.Print(os.Stdout)
+		return
+	}
+	logger := openLog(*logFile)
+	if *metricsAddr != "" {
+		go func() {
+			log.Fatal(http.ListenAndServe(*metricsAddr, expvar.Handler()))
+		}()
+	}
+	var diskCache *thumbnailer.DiskCache
+	if *sourceCacheDir != "" {
+		diskCache, err = thumbnailer.NewDiskCache(*sourceCacheDir, *sourceCacheSize, *sourceCacheTTL)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	var sourceCache *thumbnailer.SourceCache
+	if *decodedCacheSize > 0 {
+		sourceCache = thumbnailer.NewSourceCache(*decodedCacheSize, image.Pt(*decodedCacheDim, *decodedCacheDim))
+	}
+	srv, err := newServer(conf, logger, diskCache, sourceCache, nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	current.Store(srv)
+	go watchConfig(conf, *configPoll, func(conf *config.Config) error {
+		srv, err := newServer(conf, logger, diskCache, sourceCache, currentServer())
+		if err != nil {
+			return err
+		}
+		current.Store(srv)
+		return nil
+	})
+	jobs = NewJobQueue(func() *thumbnailer.Thumbnailer { return currentServer().thumbs }, *jobWorkers, *jobQueueSize, *jobRetention, *jobMax)
 	fmt.Println("Starting HTTP thumbnailer on: ", *addr)
 	URLNames["/"] = "/"
 	URLNames["/thumbs/"] = "/thumbs/"
 	URLNames["/thumb/"] = "/thumb/"
 	URLNames["/base64Encode/"] = "/debug-base64Encode/"
+	URLNames["/jobs/"] = "/jobs/"
+	URLNames["/upload"] = "/upload"
 
 	mux := http.NewServeMux()
 	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte("This is the home page"))
 	})
 
-	mux.HandleFunc(URLNames["/base64Encode/"], base64EncodeHandler)
-	mux.HandleFunc(URLNames["/thumbs/"], ThumbsHandler)
-	mux.HandleFunc(URLNames["/thumb/"], ThumbHandler)
+	mux.HandleFunc(URLNames["/base64Encode/"], limiter.limitIP(authenticate(limiter.limitKey(base64EncodeHandler))))
+	mux.HandleFunc(URLNames["/thumbs/"], limiter.limitIP(authenticate(limiter.limitKey(ThumbsHandler))))
+	mux.HandleFunc(URLNames["/thumb/"], limiter.limitIP(authenticate(limiter.limitKey(ThumbHandler))))
+	mux.HandleFunc("/jobs", limiter.limitIP(authenticate(limiter.limitKey(JobsHandler))))
+	mux.HandleFunc(URLNames["/upload"], limiter.limitIP(authenticate(limiter.limitKey(UploadHandler))))
+	mux.HandleFunc(URLNames["/jobs/"], limiter.limitIP(authenticate(limiter.limitKey(JobsHandler))))
+	mux.HandleFunc("/healthz", HealthzHandler)
+	mux.HandleFunc("/readyz", ReadyzHandler)
+	mux.HandleFunc("/version", VersionHandler)
 	http.ListenAndServe(*addr, mux)
 }
+
+// openLog sends the logs to the file filename, appended to, when it is set.
+func openLog(filename string) *log.Logger {
+	if filename != "" {
+		f, err := os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.SetOutput(f)
+	}
+	return log.New(log.Writer(), "", log.LstdFlags)
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/yml/thumbnailer"
+	"github.com/yml/thumbnailer/config"
+)
+
+// setFlag sets the flag name to value until the end of the test.
+func setFlag(t *testing.T, name, value string) {
+	f := flag.Lookup(name)
+	old := f.Value.String()
+	if err := f.Value.Set(value); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Value.Set(old) })
+}
+
+func Test_newServerReload(t *testing.T) {
+	setFlag(t, "workers", "1")
+	setFlag(t, "s3-access-key", "access")
+	setFlag(t, "s3-secret-key", "secret")
+	conf := &config.Config{}
+	logger := log.New(ioutil.Discard, "", 0)
+	prev, err := newServer(conf, logger, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A thumbnail of prev takes its only worker until release is closed
+	m := thumbnailer.NewMemStorage()
+	release := make(chan struct{})
+	defer close(release)
+	blocking := testServer(t, m, release).thumbs
+	thumbs := prev.thumbs.Clone(thumbnailer.WithStorage("mem", m.Storage), thumbnailer.WithStorage("block", func(u *url.URL, c *thumbnailer.Codec) (thumbnailer.ImageOpenSaver, error) {
+		return blocking.NewImageOpenSaver(u)
+	}))
+	go thumbs.Process(&thumbnailer.ThumbnailerMessage{
+		SrcImage:  "mem://src/pic.jpg",
+		DstFolder: "block://dst",
+		Opts:      []thumbnailer.ThumbnailOpt{{Width: 100}},
+	})
+	for deadline := time.Now().Add(10 * time.Second); ; {
+		if busy, _ := prev.thumbs.Load(); busy == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected the worker of prev to be busy")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	srv, err := newServer(conf, logger, nil, nil, prev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, thumbs := range []*thumbnailer.Thumbnailer{srv.thumbs, srv.uploadThumbs} {
+		if busy, capacity := thumbs.Load(); busy != 1 || capacity != 1 {
+			t.Fatalf("expected the reloaded server to share the worker of prev, got %d/%d", busy, capacity)
+		}
+	}
+
+	// The new number of workers is not shared
+	setFlag(t, "workers", "2")
+	srv, err = newServer(conf, logger, nil, nil, prev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if busy, capacity := srv.thumbs.Load(); busy != 0 || capacity != 2 {
+		t.Fatalf("got: %d/%d workers, expected: 0/2", busy, capacity)
+	}
+}
+
+func Test_ThumbsHandlerLimits(t *testing.T) {
+	URLNames["/thumbs/"] = "/thumbs/"
+	m := thumbnailer.NewMemStorage()
+	srv := testServer(t, m, nil)
+	srv.thumbs = srv.thumbs.Clone(thumbnailer.WithLimits(thumbnailer.Limits{MaxOpts: 1, MaxWidth: 100, MaxHeight: 100}))
+	srv.maxBodySize = 128
+	current.Store(srv)
+	post := func(body string) int {
+		w := httptest.NewRecorder()
+		ThumbsHandler(w, httptest.NewRequest("POST", "/thumbs/", strings.NewReader(body)))
+		return w.Code
+	}
+
+	for body, expected := range map[string]int{
+		`{"srcImage": "mem://src/pic.jpg", "dstFolder": "mem://dst/", "opts": [{"width": 100}]}`:                            http.StatusOK,
+		`{"srcImage": "mem://src/pic.jpg", "dstFolder": "mem://dst/", "opts": [{"width": 50}, {"width": 60}]}`:              http.StatusRequestEntityTooLarge,
+		`{"srcImage": "mem://src/pic.jpg", "dstFolder": "mem://dst/", "opts": [{"width": 200}]}`:                            http.StatusRequestEntityTooLarge,
+		`{"srcImage": "mem://src/pic.jpg", "dstFolder": "mem://dst/", "opts": [{"height": 100}]}`:                           http.StatusRequestEntityTooLarge,
+		`{"srcImage": "mem://src/pic.jpg", "dstFolder": "mem://dst/", "opts": [{"width": 100}]}` + strings.Repeat(" ", 128): http.StatusRequestEntityTooLarge,
+	} {
+		if code := post(body); code != expected {
+			t.Fatalf("%s: got %d, expected %d", body, code, expected)
+		}
+	}
+	// The GET requests are limited before they are decoded
+	w := httptest.NewRecorder()
+	ThumbsHandler(w, httptest.NewRequest("GET", "/thumbs/"+strings.Repeat("A", 256), nil))
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("got %d, expected 413", w.Code)
+	}
+}
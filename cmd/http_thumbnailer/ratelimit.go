@@ -0,0 +1,134 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The clients of the rate limiter.
+const (
+	rateByIP     = "ip"
+	rateByAPIKey = "api-key"
+)
+
+var rateLimited = expvar.NewInt("http_rate_limited")
+
+// rateLimiter limits the requests of each client with a token bucket: a
+// client holds up to burst tokens, refilled at rate tokens per second, and
+// each request takes one. The rate and the burst are given by the server
+// current when the request starts, the buckets are kept across the reloads.
+type rateLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	swept   time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+var limiter = &rateLimiter{buckets: make(map[string]*bucket)}
+
+// take takes a token from the bucket of client, when it is empty it returns
+// the time until the next token.
+func (l *rateLimiter) take(client string, rate float64, burst int, now time.Time) (bool, time.Duration) {
+	capacity := math.Max(1, float64(burst))
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.sweep(rate, capacity, now)
+	b, ok := l.buckets[client]
+	if !ok {
+		b = &bucket{tokens: capacity, last: now}
+		l.buckets[client] = b
+	}
+	b.tokens = math.Min(capacity, b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / rate * float64(time.Second))
+}
+
+// sweep forgets, at most once a minute, the clients whose bucket is full
+// again.
+func (l *rateLimiter) sweep(rate, capacity float64, now time.Time) {
+	if now.Sub(l.swept) < time.Minute {
+		return
+	}
+	l.swept = now
+	for client, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*rate >= capacity {
+			delete(l.buckets, client)
+		}
+	}
+}
+
+// limitIP wraps h, in front of authenticate, the requests exceeding the rate
+// of their IP address are refused with 429 Too Many Requests and a
+// Retry-After header. With rateByAPIKey only the requests without a known key
+// are limited by their IP address, before they are refused by authenticate,
+// the others are limited by limitKey.
+func (l *rateLimiter) limitIP(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		srv := currentServer()
+		if srv.rateLimit <= 0 || srv.rateLimitBy == rateByAPIKey && lookupKey(r, srv.apiKeys) != nil {
+			h(w, r)
+			return
+		}
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			host = r.RemoteAddr
+		}
+		if l.allow(w, "ip:"+host, srv) {
+			h(w, r)
+		}
+	}
+}
+
+// limitKey wraps h, after authenticate, with rateByAPIKey the requests
+// exceeding the rate of their API key are refused like in limitIP.
+func (l *rateLimiter) limitKey(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		srv := currentServer()
+		key := keyOf(r)
+		if srv.rateLimit <= 0 || srv.rateLimitBy != rateByAPIKey || key == nil {
+			h(w, r)
+			return
+		}
+		if l.allow(w, "key:"+key.Name(), srv) {
+			h(w, r)
+		}
+	}
+}
+
+// allow takes a token for client, when there is none the request is refused
+// with 429 Too Many Requests.
+func (l *rateLimiter) allow(w http.ResponseWriter, client string, srv *server) bool {
+	ok, wait := l.take(client, srv.rateLimit, srv.rateBurst, time.Now())
+	if !ok {
+		rateLimited.Add(1)
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		http.Error(w, fmt.Sprintf("Too many requests, retry in %s", wait.Round(time.Millisecond)), http.StatusTooManyRequests)
+	}
+	return ok
+}
+
+// apiKey returns the API key of r, empty when there is none.
+func apiKey(r *http.Request) string {
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		return key
+	}
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimSpace(strings.TrimPrefix(auth, "Bearer "))
+	}
+	return ""
+}
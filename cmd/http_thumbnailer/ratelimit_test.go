@@ -0,0 +1,99 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// testKeys returns API keys named after their key, scoped to endpoints.
+func testKeys(endpoints []string, keys ...string) map[string]*authKey {
+	m := make(map[string]*authKey, len(keys))
+	for _, key := range keys {
+		sum := sha256.Sum256([]byte(key))
+		k := &authKey{SHA256: hex.EncodeToString(sum[:]), Endpoints: endpoints, name: key}
+		m[k.SHA256] = k
+	}
+	return m
+}
+
+// do sends a GET request to path from the IP address ip with the API key
+// key, and returns the status of the response.
+func do(h http.HandlerFunc, path, ip, key string) int {
+	r := httptest.NewRequest("GET", path, nil)
+	r.RemoteAddr = ip + ":1234"
+	if key != "" {
+		r.Header.Set("Authorization", "Bearer "+key)
+	}
+	w := httptest.NewRecorder()
+	h(w, r)
+	return w.Code
+}
+
+func ok(w http.ResponseWriter, r *http.Request) {}
+
+func Test_rateLimitByAPIKey(t *testing.T) {
+	current.Store(&server{rateLimit: 0.001, rateBurst: 2, rateLimitBy: rateByAPIKey, apiKeys: testKeys(nil, "a", "b")})
+	l := &rateLimiter{buckets: make(map[string]*bucket)}
+	h := l.limitIP(authenticate(l.limitKey(ok)))
+
+	for i, expected := range []int{401, 401, 429} {
+		if code := do(h, "/thumbs/", "10.0.0.1", "unknown"); code != expected {
+			t.Fatalf("unknown key, request %d: got %d, expected %d", i, code, expected)
+		}
+	}
+	// The keys are not limited by the IP address they share
+	for i, expected := range []int{200, 200, 429} {
+		if code := do(h, "/thumbs/", "10.0.0.1", "a"); code != expected {
+			t.Fatalf("key a, request %d: got %d, expected %d", i, code, expected)
+		}
+	}
+	if code := do(h, "/thumbs/", "10.0.0.2", "a"); code != 429 {
+		t.Fatalf("expected key a to be limited from another IP address, got %d", code)
+	}
+	if code := do(h, "/thumbs/", "10.0.0.1", "b"); code != 200 {
+		t.Fatalf("expected key b not to be limited, got %d", code)
+	}
+	if code := do(h, "/thumbs/", "10.0.0.2", ""); code != 401 {
+		t.Fatalf("expected another IP address not to be limited, got %d", code)
+	}
+}
+
+func Test_rateLimitByIP(t *testing.T) {
+	current.Store(&server{rateLimit: 0.001, rateBurst: 2, rateLimitBy: rateByIP, apiKeys: testKeys([]string{"/thumbs/"}, "a", "b")})
+	l := &rateLimiter{buckets: make(map[string]*bucket)}
+	h := l.limitIP(authenticate(l.limitKey(ok)))
+
+	// The requests refused with 401 and 403 count for their IP address
+	for i, c := range []struct {
+		path, key string
+		expected  int
+	}{
+		{"/thumbs/", "", 401},
+		{"/jobs", "a", 403},
+		{"/thumbs/", "b", 429},
+	} {
+		if code := do(h, c.path, "10.0.0.1", c.key); code != c.expected {
+			t.Fatalf("request %d: got %d, expected %d", i, code, c.expected)
+		}
+	}
+	if code := do(h, "/thumbs/", "10.0.0.2", "a"); code != 200 {
+		t.Fatalf("expected another IP address not to be limited, got %d", code)
+	}
+}
+
+func Test_rateLimitRetryAfter(t *testing.T) {
+	current.Store(&server{rateLimit: 0.5, rateBurst: 1, rateLimitBy: rateByIP})
+	l := &rateLimiter{buckets: make(map[string]*bucket)}
+	h := l.limitIP(authenticate(l.limitKey(ok)))
+	do(h, "/thumbs/", "10.0.0.1", "")
+	r := httptest.NewRequest("GET", "/thumbs/", nil)
+	r.RemoteAddr = "10.0.0.1:1234"
+	w := httptest.NewRecorder()
+	h(w, r)
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "2" {
+		t.Fatalf("got %d, Retry-After: %q, expected 429, Retry-After: 2", w.Code, w.Header().Get("Retry-After"))
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"expvar"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/yml/thumbnailer/config"
+)
+
+// reloadMetrics exposes the outcome of the configuration reloads.
+var reloadMetrics = expvar.NewMap("config_reload")
+
+// watchConfig reloads the configuration on SIGHUP, and when its file is
+// modified if poll is set. apply switches to the new configuration, the
+// current one is kept when it fails.
+func watchConfig(conf *config.Config, poll time.Duration, apply func(*config.Config) error) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	var tick <-chan time.Time
+	var modTime time.Time
+	if poll > 0 && conf.File != "" {
+		ticker := time.NewTicker(poll)
+		defer ticker.Stop()
+		tick = ticker.C
+		modTime = fileModTime(conf.File)
+	}
+	for {
+		select {
+		case <-hup:
+			log.Println("Reloading the configuration on SIGHUP")
+		case <-tick:
+			mt := fileModTime(conf.File)
+			if mt.Equal(modTime) {
+				continue
+			}
+			modTime = mt
+			log.Println("Reloading the modified configuration", conf.File)
+		}
+		if err := conf.Reload(apply); err != nil {
+			log.Println("An error occured while reloading the configuration, the current one is kept:", err)
+			reloadMetrics.Add("failures", 1)
+			lastError := new(expvar.String)
+			lastError.Set(err.Error())
+			reloadMetrics.Set("last_error", lastError)
+			continue
+		}
+		log.Println("The configuration is reloaded")
+		reloadMetrics.Add("successes", 1)
+		lastReload := new(expvar.String)
+		lastReload.Set(time.Now().Format(time.RFC3339))
+		reloadMetrics.Set("last_success", lastReload)
+	}
+}
+
+// fileModTime returns the modification time of filename, or the zero time
+// when it can not be read.
+func fileModTime(filename string) time.Time {
+	fi, err := os.Stat(filename)
+	if err != nil {
+		return time.Time{}
+	}
+	return fi.ModTime()
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"unicode"
+
+	"github.com/yml/thumbnailer"
+)
+
+// uploads holds the uploaded images which are not persisted while their
+// thumbnails are generated, under the upload:// scheme. Only the Thumbnailer
+// of the uploads supports the scheme, and never as a destination.
+var uploads = thumbnailer.NewMemStorage()
+
+// UploadHandler generates the thumbnails of an uploaded image. It accepts a
+// POST multipart/form-data request with :
+// * file: the image
+// * opts: the json thumbnail request, without srcImage
+// curl 127.0.0.1:9900/upload -F file=@baignade.jpg -F opts='{"opts": [{"width":0, "height":350}], "dstFolder":"s3://nsq-thumb-dst-test/"}'
+// The image is saved to -upload-folder when it is set.
+func UploadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, fmt.Sprintf("Request method not supported: %s", r.Method), http.StatusBadRequest)
+		return
+	}
+	srv := currentServer()
+	r.Body = http.MaxBytesReader(w, r.Body, srv.uploadMaxSize)
+	defer r.Body.Close()
+	if err := r.ParseMultipartForm(srv.uploadMaxSize); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, fmt.Sprintf("The upload exceeds %d bytes", tooLarge.Limit), http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, fmt.Sprintf("failed to parse the upload: %s", err), http.StatusBadRequest)
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	tm := thumbnailer.ThumbnailerMessage{DstFolder: srv.dstFolder}
+	if opts := r.FormValue("opts"); opts != "" {
+		if err := json.Unmarshal([]byte(opts), &tm); err != nil {
+			http.Error(w, fmt.Sprintf("ERROR: failed to unmarshal `opts` into a thumbnailerMessage - %s", err), http.StatusBadRequest)
+			return
+		}
+	}
+	if err := srv.uploadThumbs.Validate(&tm); err != nil {
+		http.Error(w, err.Error(), validationStatus(err))
+		return
+	}
+	for _, dst := range tm.Destinations() {
+		if u, err := url.Parse(dst); err == nil && u.Scheme == "upload" {
+			http.Error(w, fmt.Sprintf("Unsupported destination: %s", dst), http.StatusBadRequest)
+			return
+		}
+	}
+	// The source is the upload
+	key := keyOf(r)
+	if err := key.allowDestinations(&tm); err != nil {
+		forbidden(w, r, key, err)
+		return
+	}
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to read the uploaded file: %s", err), http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+	data, err := ioutil.ReadAll(file)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to read the uploaded file: %s", err), http.StatusBadRequest)
+		return
+	}
+	name, err := uploadName(header.Filename)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// Only the images are persisted
+	if err := srv.uploadThumbs.CheckImage(bytes.NewReader(data), filepath.Ext(name)); err != nil {
+		http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+		return
+	}
+
+	if srv.uploadFolder != "" {
+		tm.SrcImage = strings.TrimSuffix(srv.uploadFolder, "/") + "/" + name
+		if err := saveUpload(srv.uploadThumbs, tm.SrcImage, data); err != nil {
+			http.Error(w, fmt.Sprintf("failed to save the uploaded file: %s", err), http.StatusInternalServerError)
+			return
+		}
+	} else {
+		uploads.Put("uploads/"+name, data)
+		defer uploads.Delete("uploads/" + name)
+		tm.SrcImage = "upload://uploads/" + name
+		// The image is not kept anyway
+		tm.DeleteSrc = false
+	}
+
+	results, err := srv.uploadThumbs.Process(&tm)
+	audit(key.Name(), r.Method+" "+r.URL.Path, tm.SrcImage, thumbnailer.CallbackResults(results))
+	callback := thumbnailer.Callback{SrcImage: tm.SrcImage, Status: "done", Results: thumbnailer.CallbackResults(results)}
+	status := http.StatusOK
+	if err != nil {
+		callback.Status = "failed"
+		callback.Error = err.Error()
+		status = processStatus(err)
+	}
+	body, err := json.Marshal(callback)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+// uploadName returns a unique name for the uploaded file filename, it keeps
+// its base name and extension, the other characters than letters, digits,
+// dots, dashes and underscores are replaced.
+func uploadName(filename string) (string, error) {
+	base := filename[strings.LastIndexAny(filename, `/\`)+1:]
+	if filepath.Ext(base) == "" || strings.HasPrefix(base, ".") {
+		return "", fmt.Errorf("Unsupported file name: %q", filename)
+	}
+	base = strings.Map(func(r rune) rune {
+		if r < 128 && (unicode.IsLetter(r) || unicode.IsDigit(r) || strings.ContainsRune("._-", r)) {
+			return r
+		}
+		return '_'
+	}, base)
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id) + "_" + base, nil
+}
+
+// saveUpload saves the encoded image data to dst.
+func saveUpload(thumbs *thumbnailer.Thumbnailer, dst string, data []byte) error {
+	u, err := url.Parse(dst)
+	if err != nil {
+		return err
+	}
+	saver, err := thumbs.NewImageOpenSaver(u)
+	if err != nil {
+		return err
+	}
+	raw, ok := saver.(thumbnailer.RawSaver)
+	if !ok {
+		return fmt.Errorf("The %s scheme does not support the uploads", u.Scheme)
+	}
+	return raw.SaveRaw(bytes.NewReader(data))
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/yml/thumbnailer"
+)
+
+// upload posts testdata/pic.jpg with the json request opts and the API key
+// key.
+func upload(t *testing.T, opts, key string) *httptest.ResponseRecorder {
+	data, err := ioutil.ReadFile(filepath.Join("..", "..", "testdata", "pic.jpg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	fw, err := mw.CreateFormFile("file", "pic.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw.Write(data)
+	mw.WriteField("opts", opts)
+	mw.Close()
+	r := httptest.NewRequest("POST", "/upload", &body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	r.Header.Set("Authorization", "Bearer "+key)
+	w := httptest.NewRecorder()
+	authenticate(UploadHandler)(w, r)
+	return w
+}
+
+func Test_UploadHandlerDestinations(t *testing.T) {
+	m := thumbnailer.NewMemStorage()
+	srv := testServer(t, m, nil)
+	srv.apiKeys = testKeys(nil, "a")
+	for _, k := range srv.apiKeys {
+		k.Destinations = []string{"mem://thumbs/a/"}
+	}
+	current.Store(srv)
+
+	w := upload(t, `{"dstFolder": "mem://thumbs/a/", "opts": [{"width": 100}]}`, "a")
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d %s, expected 200", w.Code, w.Body)
+	}
+	var callback thumbnailer.Callback
+	if err := json.NewDecoder(w.Body).Decode(&callback); err != nil {
+		t.Fatal(err)
+	}
+	if len(callback.Results) != 1 || !strings.HasPrefix(callback.Results[0].Thumbnail, "mem://thumbs/a/") {
+		t.Fatalf("unexpected results %+v", callback.Results)
+	}
+
+	// The destination folder is out of the scope of the key
+	if w := upload(t, `{"dstFolder": "mem://thumbs/b", "opts": [{"width": 100}]}`, "a"); w.Code != http.StatusForbidden {
+		t.Fatalf("got %d %s, expected 403", w.Code, w.Body)
+	}
+	// The ".." segments never match a scope
+	if w := upload(t, `{"dstFolder": "mem://thumbs/a/../b/", "opts": [{"width": 100}]}`, "a"); w.Code != http.StatusForbidden {
+		t.Fatalf("got %d %s, expected 403", w.Code, w.Body)
+	}
+	for _, key := range m.Keys() {
+		if strings.HasPrefix(key, "thumbs/b/") {
+			t.Fatalf("expected no thumbnail out of the scope of the key, got %s", key)
+		}
+	}
+	if keys := uploads.Keys(); len(keys) != 0 {
+		t.Fatalf("expected the uploads not to be kept, got %v", keys)
+	}
+}
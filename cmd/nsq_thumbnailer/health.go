@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/bitly/go-nsq"
+	"github.com/yml/thumbnailer"
+)
+
+// nsqState is the state of the consumer reported by /readyz.
+type nsqState struct {
+	Ready            bool   `json:"ready"`
+	Stopping         bool   `json:"stopping"`
+	Connections      int    `json:"connections"`
+	MessagesReceived uint64 `json:"messagesReceived"`
+	MessagesFinished uint64 `json:"messagesFinished"`
+	MessagesRequeued uint64 `json:"messagesRequeued"`
+	BusyWorkers      int    `json:"busyWorkers"`
+	Workers          int    `json:"workers,omitempty"`
+}
+
+// healthMux returns the handler of the -http-address listener:
+// * /healthz tells that the process is alive
+// * /readyz reports the NSQ connections, 503 when there is none or when the
+// consumer is stopping
+// * /version returns the build information
+// * /debug/vars returns the expvar metrics
+func healthMux(consumer *nsq.Consumer, thumbs *thumbnailer.Thumbnailer, stopping *int32) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok\n"))
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		stats := consumer.Stats()
+		state := nsqState{
+			Stopping:         atomic.LoadInt32(stopping) != 0,
+			Connections:      stats.Connections,
+			MessagesReceived: stats.MessagesReceived,
+			MessagesFinished: stats.MessagesFinished,
+			MessagesRequeued: stats.MessagesRequeued,
+		}
+		state.BusyWorkers, state.Workers = thumbs.Load()
+		state.Ready = state.Connections > 0 && !state.Stopping
+		status := http.StatusOK
+		if !state.Ready {
+			status = http.StatusServiceUnavailable
+		}
+		writeJSON(w, state, status)
+	})
+	mux.HandleFunc("/version", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, struct {
+			thumbnailer.BuildInfo
+			NSQVersion string `json:"nsqVersion"`
+		}{thumbs.BuildInfo(), nsq.VERSION}, http.StatusOK)
+	})
+	mux.Handle("/debug/vars", expvar.Handler())
+	return mux
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}, status int) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("An error occured while encoding the response: %s", err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(body)
+}
@@ -1,19 +1,24 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"expvar"
 	"flag"
 	"fmt"
 	"log"
 	"math/rand"
+	"net/http"
 	"os"
 	"os/signal"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/bitly/go-nsq"
 	"github.com/bitly/nsq/util"
 	"github.com/yml/thumbnailer"
+	"github.com/yml/thumbnailer/config"
 )
 
 var (
@@ -22,6 +27,37 @@ var (
 	channel          = flag.String("channel", "", "NSQ channel")
 	concurrency      = flag.Int("concurrency", 1, "Handler concurrency default is 1")
 	maxInFlight      = flag.Int("max-in-flight", 200, "max number of messages to allow in flight")
+	workers          = flag.Int("workers", 0, "max number of thumbnails generated concurrently (default is no limit)")
+	filter           = flag.String("filter", string(thumbnailer.DefaultFilter), "default resampling filter (lanczos, catmullrom, linear, box, nearestneighbor, mitchellnetravali)")
+	fileMode         = flag.String("file-mode", "0644", "permissions of the thumbnails saved with the file:// scheme")
+	dirMode          = flag.String("dir-mode", "0755", "permissions of the directories created with the file:// scheme")
+	s3ACL            = flag.String("s3-acl", "public-read", "canned ACL of the thumbnails uploaded to S3")
+	s3CacheControl   = flag.String("s3-cache-control", "", "Cache-Control header of the thumbnails uploaded to S3")
+	s3StorageClass   = flag.String("s3-storage-class", "", "storage class of the thumbnails uploaded to S3")
+	s3SSE            = flag.String("s3-sse", "", "server side encryption of the thumbnails uploaded to S3 (AES256, aws:kms)")
+	retries          = flag.Int("retries", thumbnailer.DefaultRetryPolicy.MaxAttempts-1, "number of retries of the failed storage operations")
+	retryDelay       = flag.Duration("retry-delay", thumbnailer.DefaultRetryPolicy.BaseDelay, "delay before the first retry, doubled after each retry")
+	retryMaxDelay    = flag.Duration("retry-max-delay", thumbnailer.DefaultRetryPolicy.MaxDelay, "maximum delay between two retries")
+	retryTimeout     = flag.Duration("retry-timeout", thumbnailer.DefaultRetryPolicy.Timeout, "maximum time spent on a storage operation, retries included")
+	breakerThreshold = flag.Int("breaker-threshold", thumbnailer.DefaultRetryPolicy.BreakerThreshold, "consecutive failures opening the circuit breaker of a host or bucket (0 disables it)")
+	breakerCooldown  = flag.Duration("breaker-cooldown", thumbnailer.DefaultRetryPolicy.BreakerCooldown, "time the circuit breaker stays open")
+	sourceCacheDir   = flag.String("source-cache-dir", "", "directory caching the S3 source images (disabled when empty)")
+	sourceCacheSize  = flag.Int64("source-cache-size", 1<<30, "maximum size in bytes of the source cache")
+	sourceCacheTTL   = flag.Duration("source-cache-ttl", 24*time.Hour, "time the source images are kept in the cache")
+	nameTemplate     = flag.String("name-template", thumbnailer.DefaultNameTemplate, "template, or preset name (default, folder, hashed, content), used to name the thumbnails")
+	s3AccessKey      = flag.String("s3-access-key", "", "s3 access key (AWS_ACCESS_KEY_ID is used when empty)")
+	s3SecretKey      = flag.String("s3-secret-key", "", "s3 secret key (AWS_SECRET_ACCESS_KEY is used when empty)")
+	s3Region         = flag.String("s3-region", "us-east-1", "s3 region, the regions requiring the AWS signature version 4 (eu-central-1...) are not supported")
+	maxOpts          = flag.Int("max-opts", 0, "maximum number of opts of a request (0 means no limit)")
+	maxWidth         = flag.Int("max-width", 0, "maximum width of a thumbnail (0 means no limit)")
+	maxHeight        = flag.Int("max-height", 0, "maximum height of a thumbnail (0 means no limit)")
+	logFile          = flag.String("log-file", "", "file the logs are appended to (stderr when empty)")
+	httpAddr         = flag.String("http-address", "", "address serving /healthz, /readyz, /version and /debug/vars (disabled when empty)")
+	metricsAddr      = flag.String("metrics-addr", "", "address serving the expvar metrics on /debug/vars (disabled when empty)")
+	presetsFile      = flag.String("presets", "", "JSON file of the named thumbnail presets, e.g. {\"avatar\": {\"width\": 64, \"height\": 64}}")
+	callbackSecret   = flag.String("callback-secret", "", "secret signing the callback requests with HMAC-SHA256 (unsigned when empty)")
+	callbackTimeout  = flag.Duration("callback-timeout", thumbnailer.DefaultCallbackTimeout, "timeout of each callback request")
+	callbackRetries  = flag.Int("callback-retries", thumbnailer.DefaultRetryPolicy.MaxAttempts-1, "number of retries of the failed callback requests")
 	consumerOpts     = util.StringArray{}
 	nsqdTCPAddrs     = util.StringArray{}
 	lookupdHTTPAddrs = util.StringArray{}
@@ -34,8 +70,7 @@ func init() {
 }
 
 type thumbnailerHandler struct {
-	sourceImage      string
-	thumbnailCounter int
+	thumbs *thumbnailer.Thumbnailer
 }
 
 func (th *thumbnailerHandler) HandleMessage(m *nsq.Message) error {
@@ -46,27 +81,21 @@ func (th *thumbnailerHandler) HandleMessage(m *nsq.Message) error {
 		return err
 	}
 
-	resultChan := tm.GenerateThumbnails()
-	results := make([]thumbnailer.ThumbnailResult, 0)
-	for result := range resultChan {
-		results = append(results, result)
-	}
-	for _, r := range results {
-		if r.Err != nil {
-			return fmt.Errorf("Error: At least one thumb generation failed - %s", r.Err, results)
-		}
-	}
-
-	if tm.DeleteSrc == true {
-		fmt.Println("Deleting", tm.SrcImage)
-		err = tm.DeleteImage()
-	}
+	_, err = th.thumbs.Process(&tm)
 	return err
 }
 
 func main() {
+	conf, err := config.Parse(flag.CommandLine, os.Args[1:])
+	if err != nil {
+		log.Fatal(err)
+	}
+	if conf.PrintConfig {
+		conf.Print(os.Stdout)
+		return
+	}
+	logger := openLog(*logFile)
 	log.Println("Starting nsq_thumbnailing consumer")
-	flag.Parse()
 
 	if *showVersion {
 		fmt.Printf("nsq_thumbnailer v%s\n", util.BINARY_VERSION)
@@ -89,12 +118,74 @@ func main() {
 		log.Fatal("use --nsqd-tcp-address or --lookupd-http-address not both")
 	}
 
+	f, err := thumbnailer.ParseFilter(*filter)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if _, err := thumbnailer.ParseNameTemplate(*nameTemplate); err != nil {
+		log.Fatal(err)
+	}
+	fm, err := thumbnailer.ParseFileMode(*fileMode)
+	if err != nil {
+		log.Fatal(err)
+	}
+	dm, err := thumbnailer.ParseFileMode(*dirMode)
+	if err != nil {
+		log.Fatal(err)
+	}
+	s3Options := thumbnailer.S3Options{
+		ACL:                  *s3ACL,
+		CacheControl:         *s3CacheControl,
+		StorageClass:         *s3StorageClass,
+		ServerSideEncryption: *s3SSE,
+	}
+	if err := s3Options.Validate(); err != nil {
+		log.Fatal(err)
+	}
+	retryPolicy := thumbnailer.RetryPolicy{
+		MaxAttempts:      *retries + 1,
+		BaseDelay:        *retryDelay,
+		MaxDelay:         *retryMaxDelay,
+		Timeout:          *retryTimeout,
+		BreakerThreshold: *breakerThreshold,
+		BreakerCooldown:  *breakerCooldown,
+	}
+	presets := conf.Presets
+	if presets == nil && *presetsFile != "" {
+		presets, err = thumbnailer.ReadPresets(*presetsFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *metricsAddr != "" {
+		go func() {
+			log.Fatal(http.ListenAndServe(*metricsAddr, expvar.Handler()))
+		}()
+	}
+	callbackPolicy := retryPolicy
+	callbackPolicy.MaxAttempts = *callbackRetries + 1
+
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	// The retries are abandoned once the consumer is stopping
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s3Base, err := thumbnailer.NewS3Storage(*s3AccessKey, *s3SecretKey, *s3Region, s3Options)
+	if err != nil {
+		log.Fatal(err)
+	}
+	s3Storage := thumbnailer.Retry(ctx, s3Base, retryPolicy)
+	if *sourceCacheDir != "" {
+		cache, err := thumbnailer.NewDiskCache(*sourceCacheDir, *sourceCacheSize, *sourceCacheTTL)
+		if err != nil {
+			log.Fatal(err)
+		}
+		s3Storage = cache.Storage(s3Storage)
+	}
 
 	cfg := nsq.NewConfig()
 	cfg.UserAgent = fmt.Sprintf("nsq_thumbnailer/%s go-nsq/%s", util.BINARY_VERSION, nsq.VERSION)
-	err := util.ParseOpts(cfg, consumerOpts)
+	err = util.ParseOpts(cfg, consumerOpts)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -106,7 +197,28 @@ func main() {
 	}
 
 	fmt.Println("concurrency: ", *concurrency)
-	consumer.AddConcurrentHandlers(&thumbnailerHandler{}, *concurrency)
+	handler := &thumbnailerHandler{
+		thumbs: thumbnailer.New(
+			thumbnailer.WithWorkers(*workers),
+			thumbnailer.WithLimits(thumbnailer.Limits{MaxOpts: *maxOpts, MaxWidth: *maxWidth, MaxHeight: *maxHeight}),
+			thumbnailer.WithLogger(logger),
+			thumbnailer.WithFilter(f),
+			thumbnailer.WithNameTemplate(*nameTemplate),
+			thumbnailer.WithStorage("file", thumbnailer.Retry(ctx, thumbnailer.FileStorageMode(fm, dm), retryPolicy)),
+			thumbnailer.WithStorage("s3", s3Storage),
+			thumbnailer.WithS3Options(s3Options),
+			thumbnailer.WithPresets(presets),
+			thumbnailer.WithCallbacks(*callbackSecret, *callbackTimeout, callbackPolicy),
+		),
+	}
+	consumer.AddConcurrentHandlers(handler, *concurrency)
+
+	var stopping int32
+	if *httpAddr != "" {
+		go func() {
+			log.Fatal(http.ListenAndServe(*httpAddr, healthMux(consumer, handler.thumbs, &stopping)))
+		}()
+	}
 
 	err = consumer.ConnectToNSQDs(nsqdTCPAddrs)
 	if err != nil {
@@ -123,7 +235,21 @@ func main() {
 		case <-consumer.StopChan:
 			return
 		case <-sigChan:
+			atomic.StoreInt32(&stopping, 1)
+			cancel()
 			consumer.Stop()
 		}
 	}
 }
+
+// openLog sends the logs to the file filename, appended to, when it is set.
+func openLog(filename string) *log.Logger {
+	if filename != "" {
+		f, err := os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.SetOutput(f)
+	}
+	return log.New(log.Writer(), "", log.LstdFlags)
+}
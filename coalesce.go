@@ -0,0 +1,88 @@
+package thumbnailer
+
+import (
+	"fmt"
+	"net/url"
+	"sync"
+)
+
+// flightGroup coalesces the identical thumbnails requested concurrently,
+// they are generated once and their results are shared.
+type flightGroup struct {
+	mu      sync.Mutex
+	flights map[string]*thumbFlight
+}
+
+// thumbFlight is a thumbnail being generated.
+type thumbFlight struct {
+	key     string
+	done    chan struct{}
+	waiters int
+	results []ThumbnailResult
+}
+
+// thumbKey identifies the thumbnail of opt made from srcURL and saved to
+// thumbURLs with the S3Options s3, opt is resolved.
+func thumbKey(srcURL *url.URL, s3 S3Options, opt ThumbnailOpt, thumbURLs []*url.URL) string {
+	key := fmt.Sprintf("%s\n%dx%d\n%s\n%+v", srcURL, opt.Width, opt.Height, opt.Filter, s3)
+	if opt.Rect != nil {
+		key += fmt.Sprintf("\n%v", *opt.Rect)
+	}
+	for _, thumbURL := range thumbURLs {
+		key += "\n" + thumbURL.String()
+	}
+	return key
+}
+
+// join returns the flight of key, leader is set when the caller has to
+// generate the thumbnail and then finish the flight.
+func (g *flightGroup) join(key string) (f *thumbFlight, leader bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if f, ok := g.flights[key]; ok {
+		f.waiters++
+		return f, false
+	}
+	f = &thumbFlight{key: key, done: make(chan struct{})}
+	g.flights[key] = f
+	return f, true
+}
+
+// finish shares the results of f with its waiters.
+func (g *flightGroup) finish(f *thumbFlight, results []ThumbnailResult) {
+	g.mu.Lock()
+	delete(g.flights, f.key)
+	f.results = results
+	g.mu.Unlock()
+	close(f.done)
+}
+
+// coalesce returns the opts of tm, and their thumbURLs, to be generated by
+// the caller with their flights. The results of the other opts, generated by
+// concurrent requests, are sent to rc by goroutines tracked by wg.
+func (t *Thumbnailer) coalesce(rc chan<- ThumbnailResult, wg *sync.WaitGroup, tm *ThumbnailerMessage, src *source, opts []ThumbnailOpt, thumbURLs [][]*url.URL) ([]ThumbnailOpt, [][]*url.URL, []*thumbFlight) {
+	var leaderOpts []ThumbnailOpt
+	var leaderURLs [][]*url.URL
+	var flights []*thumbFlight
+	// The thumbnails uploaded with other S3Options are not shared
+	s3 := t.s3Options.merge(tm.S3)
+	for i, opt := range opts {
+		f, leader := t.flights.join(thumbKey(src.url, s3, opt, thumbURLs[i]))
+		if leader {
+			leaderOpts = append(leaderOpts, opt)
+			leaderURLs = append(leaderURLs, thumbURLs[i])
+			flights = append(flights, f)
+			continue
+		}
+		t.logger.Println("thumb :", thumbURLs[i][0], " already being generated")
+		wg.Add(1)
+		go func(f *thumbFlight) {
+			defer wg.Done()
+			<-f.done
+			for _, result := range f.results {
+				rc <- result
+			}
+		}(f)
+	}
+	return leaderOpts, leaderURLs, flights
+}
@@ -0,0 +1,168 @@
+package thumbnailer
+
+import (
+	"io"
+	"io/ioutil"
+	"net/url"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// blockingImageOpenSaver counts the images saved to a MemStorage and waits
+// for release before saving them.
+type blockingImageOpenSaver struct {
+	memImageOpenSaver
+	saves   *int32
+	release chan struct{}
+}
+
+func (s blockingImageOpenSaver) SaveRaw(r io.Reader) error {
+	atomic.AddInt32(s.saves, 1)
+	<-s.release
+	return s.memImageOpenSaver.SaveRaw(r)
+}
+
+func Test_GenerateThumbnailsCoalescing(t *testing.T) {
+	data, err := ioutil.ReadFile(filepath.Join("testdata", "pic.jpg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := NewMemStorage()
+	m.Put("src/pic.jpg", data)
+	var saves int32
+	release := make(chan struct{})
+	th := New(
+		WithStorage("mem", m.Storage),
+		WithStorage("blocking", func(u *url.URL, c *Codec) (ImageOpenSaver, error) {
+			return blockingImageOpenSaver{memImageOpenSaver{URL: u, codec: c, storage: m}, &saves, release}, nil
+		}),
+	)
+
+	const requests = 5
+	var wg sync.WaitGroup
+	results := make([][]ThumbnailResult, requests)
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			tm := ThumbnailerMessage{
+				SrcImage:  "mem://src/pic.jpg",
+				DstFolder: "blocking://dst",
+				Opts:      []ThumbnailOpt{{Width: 100}},
+			}
+			results[i], _ = th.Process(&tm)
+		}(i)
+	}
+	// Wait for all the requests to join the first one
+	for deadline := time.Now().Add(10 * time.Second); ; {
+		th.flights.mu.Lock()
+		waiters := 0
+		for _, f := range th.flights.flights {
+			waiters += f.waiters
+		}
+		th.flights.mu.Unlock()
+		if waiters == requests-1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d waiters, got %d", requests-1, waiters)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	wg.Wait()
+
+	if saves := atomic.LoadInt32(&saves); saves != 1 {
+		t.Fatalf("expected a single save, got %d", saves)
+	}
+	for _, r := range results {
+		if len(r) != 1 || r[0].Err != nil || r[0].Thumbnail.String() != "blocking://dst/pic_s100x75.jpg" {
+			t.Fatalf("unexpected results %v", r)
+		}
+	}
+}
+
+func Test_GenerateThumbnailsAbandoned(t *testing.T) {
+	data, err := ioutil.ReadFile(filepath.Join("testdata", "pic.jpg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := NewMemStorage()
+	m.Put("src/pic.jpg", data)
+	var saves int32
+	release := make(chan struct{})
+	th := New(
+		WithStorage("mem", m.Storage),
+		WithStorage("blocking", func(u *url.URL, c *Codec) (ImageOpenSaver, error) {
+			return blockingImageOpenSaver{memImageOpenSaver{URL: u, codec: c, storage: m}, &saves, release}, nil
+		}),
+	)
+	newMessage := func() *ThumbnailerMessage {
+		return &ThumbnailerMessage{
+			SrcImage:  "mem://src/pic.jpg",
+			DstFolder: "blocking://dst",
+			Opts:      []ThumbnailOpt{{Width: 100}, {Width: 50}},
+		}
+	}
+
+	// The results of the leader are never read
+	th.GenerateThumbnails(newMessage())
+	for deadline := time.Now().Add(10 * time.Second); ; {
+		th.flights.mu.Lock()
+		flights := len(th.flights.flights)
+		th.flights.mu.Unlock()
+		if flights == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected 2 flights, got %d", flights)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	done := make(chan []ThumbnailResult)
+	go func() {
+		results, _ := th.Process(newMessage())
+		done <- results
+	}()
+	for deadline := time.Now().Add(10 * time.Second); ; {
+		th.flights.mu.Lock()
+		waiters := 0
+		for _, f := range th.flights.flights {
+			waiters += f.waiters
+		}
+		th.flights.mu.Unlock()
+		if waiters == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected 2 waiters, got %d", waiters)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	select {
+	case results := <-done:
+		if len(results) != 2 {
+			t.Fatalf("unexpected results %v", results)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("expected the waiters not to be blocked by the leader")
+	}
+}
+
+func Test_thumbKeyS3Options(t *testing.T) {
+	u, _ := url.Parse("mem://src/pic.jpg")
+	dst, _ := url.Parse("s3://bucket/pic_s100x75.jpg")
+	opt := ThumbnailOpt{Width: 100, Height: 75}
+	private := thumbKey(u, S3Options{ACL: "private"}, opt, []*url.URL{dst})
+	public := thumbKey(u, S3Options{ACL: "public-read"}, opt, []*url.URL{dst})
+	if private == public {
+		t.Fatal("expected the thumbnails uploaded with other S3Options not to be coalesced")
+	}
+	if private != thumbKey(u, S3Options{ACL: "private"}, opt, []*url.URL{dst}) {
+		t.Fatal("expected the same key for the same S3Options")
+	}
+}
@@ -0,0 +1,286 @@
+// Package config loads the configuration shared by the thumbnailer commands.
+//
+// The settings of a command are its flags. They are read, by increasing
+// priority, from their defaults, a YAML file given with -config, the
+// environment variables and the command line. The file maps the names of the
+// flags to their values, the repeated flags take a list:
+//
+//	addr: 127.0.0.1:9900
+//	dstFolder: s3://thumbs/
+//	s3-acl: private
+//	retry-timeout: 1m
+//	nsqd-tcp-address: [127.0.0.1:4150, 127.0.0.1:4250]
+//	presets:
+//	  avatar: {width: 64, height: 64}
+//
+// presets also accepts the path of a JSON presets file. The environment
+// variable of a flag is its upper case name prefixed by THUMBNAILER_, the
+// dashes replaced by underscores (THUMBNAILER_S3_ACL).
+package config
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/yml/thumbnailer"
+	"gopkg.in/yaml.v2"
+)
+
+// EnvPrefix prefixes the environment variables of the flags.
+const EnvPrefix = "THUMBNAILER_"
+
+// The origins of the settings.
+const (
+	FromDefault = "default"
+	FromFile    = "file"
+	FromEnv     = "env"
+	FromFlag    = "flag"
+)
+
+// Config is the effective configuration of a command.
+type Config struct {
+	// File is the configuration file loaded, empty when there is none.
+	File string
+	// Presets are the presets defined in the file, nil when they are not.
+	Presets thumbnailer.Presets
+	// PrintConfig is set by -print-config, the command should print the
+	// configuration and exit.
+	PrintConfig bool
+
+	fs      *flag.FlagSet
+	origins map[string]string
+}
+
+// Parse registers the -config and -print-config flags in fs, parses args
+// and completes the flags not set on the command line from the environment
+// and the configuration file. The errors name the setting and its origin.
+func Parse(fs *flag.FlagSet, args []string) (*Config, error) {
+	file := fs.String("config", os.Getenv(EnvPrefix+"CONFIG"), "YAML configuration file, its settings are named after the flags")
+	printConfig := fs.Bool("print-config", false, "Print the effective configuration and exit")
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	c := &Config{File: *file, PrintConfig: *printConfig, fs: fs, origins: map[string]string{}}
+	fs.Visit(func(f *flag.Flag) {
+		c.origins[f.Name] = FromFlag
+	})
+	// The environment has priority over the file
+	if err := c.loadEnv(); err != nil {
+		return nil, err
+	}
+	if c.File != "" {
+		if err := c.loadFile(c.File); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// Reload reads the environment and the configuration file again, the flags
+// set on the command line are kept. apply is called with the new settings,
+// when they are invalid or apply fails the previous ones are restored. The
+// repeated flags, whose values accumulate, should not be reloaded.
+func (c *Config) Reload(apply func(*Config) error) error {
+	values := map[string]string{}
+	c.fs.VisitAll(func(f *flag.Flag) {
+		values[f.Name] = f.Value.String()
+	})
+	origins, presets := c.origins, c.Presets
+	restore := func() {
+		for name, value := range values {
+			c.fs.Set(name, value)
+		}
+		c.origins, c.Presets = origins, presets
+	}
+
+	c.origins, c.Presets = map[string]string{}, nil
+	var err error
+	c.fs.VisitAll(func(f *flag.Flag) {
+		if origins[f.Name] == FromFlag {
+			c.origins[f.Name] = FromFlag
+		} else if origins[f.Name] != "" && err == nil {
+			err = c.fs.Set(f.Name, f.DefValue)
+		}
+	})
+	if err == nil {
+		err = c.loadEnv()
+	}
+	if err == nil && c.File != "" {
+		err = c.loadFile(c.File)
+	}
+	if err == nil {
+		err = apply(c)
+	}
+	if err != nil {
+		restore()
+	}
+	return err
+}
+
+// loadEnv sets the flags from their environment variables.
+func (c *Config) loadEnv() error {
+	var err error
+	c.fs.VisitAll(func(f *flag.Flag) {
+		name := EnvName(f.Name)
+		value, ok := os.LookupEnv(name)
+		if !ok || err != nil || c.origins[f.Name] != "" || f.Name == "config" || f.Name == "print-config" {
+			return
+		}
+		if serr := c.fs.Set(f.Name, value); serr != nil {
+			err = fmt.Errorf("Invalid value %q for %s: %s", value, name, serr)
+			return
+		}
+		c.origins[f.Name] = FromEnv
+	})
+	return err
+}
+
+// EnvName returns the environment variable of the flag name.
+func EnvName(name string) string {
+	return EnvPrefix + strings.ToUpper(strings.Replace(name, "-", "_", -1))
+}
+
+// loadFile sets the flags which are not set yet from the file filename.
+func (c *Config) loadFile(filename string) error {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return fmt.Errorf("An error occured while reading the configuration: %w", err)
+	}
+	settings := yaml.MapSlice{}
+	if err := yaml.Unmarshal(data, &settings); err != nil {
+		return fmt.Errorf("An error occured while parsing the configuration %s: %w", filename, err)
+	}
+	for _, item := range settings {
+		name := fmt.Sprint(item.Key)
+		if name == "config" || name == "print-config" {
+			return fmt.Errorf("%s: %s can not be set in the configuration", filename, name)
+		}
+		if name == "presets" {
+			if presets, ok, err := parsePresets(item.Value); err != nil {
+				return fmt.Errorf("%s: %w", filename, err)
+			} else if ok {
+				if c.origins[name] == "" {
+					c.Presets = presets
+					c.origins[name] = FromFile
+				}
+				continue
+			}
+		}
+		if c.fs.Lookup(name) == nil {
+			return fmt.Errorf("%s: unknown setting %q", filename, name)
+		}
+		if c.origins[name] != "" {
+			continue
+		}
+		values, ok := item.Value.([]interface{})
+		if !ok {
+			values = []interface{}{item.Value}
+		}
+		for _, v := range values {
+			if _, ok := v.(yaml.MapSlice); ok {
+				return fmt.Errorf("%s: invalid value for %s: a scalar is expected", filename, name)
+			}
+			if err := c.fs.Set(name, fmt.Sprint(v)); err != nil {
+				return fmt.Errorf("%s: invalid value %q for %s: %s", filename, fmt.Sprint(v), name, err)
+			}
+		}
+		c.origins[name] = FromFile
+	}
+	return nil
+}
+
+// parsePresets parses the presets defined inline, ok is false when v is the
+// path of a presets file.
+func parsePresets(v interface{}) (presets thumbnailer.Presets, ok bool, err error) {
+	if _, isMap := v.(yaml.MapSlice); !isMap {
+		return nil, false, nil
+	}
+	// The presets are converted to JSON to be decoded as ThumbnailOpts
+	data, err := json.Marshal(jsonCompatible(v))
+	if err != nil {
+		return nil, true, err
+	}
+	presets, err = thumbnailer.ParsePresets(data)
+	return presets, true, err
+}
+
+// jsonCompatible converts the maps decoded by yaml to maps keyed by strings.
+func jsonCompatible(v interface{}) interface{} {
+	switch v := v.(type) {
+	case yaml.MapSlice:
+		m := make(map[string]interface{}, len(v))
+		for _, item := range v {
+			m[fmt.Sprint(item.Key)] = jsonCompatible(item.Value)
+		}
+		return m
+	case []interface{}:
+		l := make([]interface{}, len(v))
+		for i, e := range v {
+			l[i] = jsonCompatible(e)
+		}
+		return l
+	}
+	return v
+}
+
+// Origin returns where the flag name was set: FromDefault, FromFile,
+// FromEnv or FromFlag.
+func (c *Config) Origin(name string) string {
+	if origin, ok := c.origins[name]; ok {
+		return origin
+	}
+	return FromDefault
+}
+
+// secret tells if the flag name holds a secret, hidden by Print.
+func secret(name string) bool {
+	return strings.Contains(name, "secret") || strings.Contains(name, "password") || strings.HasSuffix(name, "-key")
+}
+
+// Print writes the effective configuration to w in YAML, each setting
+// followed by its origin. The secrets are masked.
+func (c *Config) Print(w io.Writer) error {
+	var names []string
+	c.fs.VisitAll(func(f *flag.Flag) {
+		if f.Name != "config" && f.Name != "print-config" {
+			names = append(names, f.Name)
+		}
+	})
+	sort.Strings(names)
+	if c.File != "" {
+		fmt.Fprintf(w, "# configuration file: %s\n", c.File)
+	}
+	for _, name := range names {
+		if name == "presets" && c.Presets != nil {
+			continue
+		}
+		value := c.fs.Lookup(name).Value.String()
+		if secret(name) && value != "" {
+			value = "********"
+		}
+		line, err := yaml.Marshal(yaml.MapSlice{{Key: name, Value: value}})
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "%s # %s\n", strings.TrimSuffix(string(line), "\n"), c.Origin(name)); err != nil {
+			return err
+		}
+	}
+	if c.Presets != nil {
+		// JSON is a valid YAML value
+		data, err := json.Marshal(c.Presets)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "presets: %s # %s\n", data, FromFile); err != nil {
+			return err
+		}
+	}
+	return nil
+}
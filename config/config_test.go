@@ -0,0 +1,143 @@
+package config
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/yml/thumbnailer"
+)
+
+func writeConfig(t *testing.T, dir, content string) string {
+	filename := filepath.Join(dir, "config.yaml")
+	if err := ioutil.WriteFile(filename, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+func Test_Parse(t *testing.T) {
+	dir, err := ioutil.TempDir("", "thumbnailer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := writeConfig(t, dir, `
+addr: 0.0.0.0:9000
+workers: 4
+filter: box
+retry-timeout: 1m
+callback-secret: s3cr3t
+presets:
+  avatar: {width: 64, height: 64}
+`)
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	addr := fs.String("addr", "127.0.0.1:9900", "")
+	workers := fs.Int("workers", 0, "")
+	filter := fs.String("filter", "lanczos", "")
+	retryTimeout := fs.Duration("retry-timeout", 30*time.Second, "")
+	fs.String("callback-secret", "", "")
+	fs.String("presets", "", "")
+	os.Setenv("THUMBNAILER_WORKERS", "8")
+	defer os.Unsetenv("THUMBNAILER_WORKERS")
+
+	c, err := Parse(fs, []string{"-config", filename, "-filter", "linear"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *addr != "0.0.0.0:9000" || *workers != 8 || *filter != "linear" || *retryTimeout != time.Minute {
+		t.Fatalf("unexpected settings: %s %d %s %s", *addr, *workers, *filter, *retryTimeout)
+	}
+	for name, origin := range map[string]string{"addr": FromFile, "workers": FromEnv, "filter": FromFlag, "presets": FromFile} {
+		if c.Origin(name) != origin {
+			t.Errorf("got origin %s for %s, expected %s", c.Origin(name), name, origin)
+		}
+	}
+	if opt, ok := c.Presets["avatar"]; !ok || !reflect.DeepEqual(opt, thumbnailer.ThumbnailOpt{Width: 64, Height: 64}) {
+		t.Fatalf("unexpected presets: %v", c.Presets)
+	}
+
+	var buf bytes.Buffer
+	if err := c.Print(&buf); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	if strings.Contains(out, "s3cr3t") || !strings.Contains(out, "workers: \"8\" # env") || !strings.Contains(out, `presets: {"avatar":{"width":64,"height":64}} # file`) {
+		t.Fatalf("unexpected configuration:\n%s", out)
+	}
+}
+
+func Test_ParseErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "thumbnailer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for content, expected := range map[string]string{
+		"bogus: 1":                           `unknown setting "bogus"`,
+		"workers: abc":                       `invalid value "abc" for workers`,
+		"workers: {a: 1}":                    "a scalar is expected",
+		"presets:\n  50x50: {width: 50}":     `Unsupported preset name: "50x50"`,
+		"addr: [":                            "parsing the configuration",
+		"config: /etc/thumbnailer/conf.yaml": "can not be set in the configuration",
+	} {
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		fs.String("addr", "", "")
+		fs.Int("workers", 0, "")
+		fs.String("presets", "", "")
+		_, err := Parse(fs, []string{"-config", writeConfig(t, dir, content)})
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("expected an error containing %q for %q, got %v", expected, content, err)
+		}
+	}
+}
+
+func Test_Reload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "thumbnailer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := writeConfig(t, dir, "workers: 4\nfilter: box\npresets:\n  avatar: {width: 64, height: 64}\n")
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	workers := fs.Int("workers", 0, "")
+	filter := fs.String("filter", "lanczos", "")
+	addr := fs.String("addr", "127.0.0.1:9900", "")
+	fs.String("presets", "", "")
+	c, err := Parse(fs, []string{"-config", filename, "-addr", "0.0.0.0:9000"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The invalid settings are not applied
+	writeConfig(t, dir, "workers: abc\n")
+	applied := false
+	if err := c.Reload(func(*Config) error { applied = true; return nil }); err == nil || applied {
+		t.Fatal("expected the invalid configuration to be refused")
+	}
+	if *workers != 4 || *filter != "box" || c.Presets == nil {
+		t.Fatalf("expected the previous settings to be kept, got %d %s %v", *workers, *filter, c.Presets)
+	}
+
+	// The settings refused by apply are restored
+	writeConfig(t, dir, "workers: 8\n")
+	if err := c.Reload(func(*Config) error { return os.ErrInvalid }); err != os.ErrInvalid || *workers != 4 {
+		t.Fatalf("expected the previous settings to be restored, got %v %d", err, *workers)
+	}
+
+	// The settings removed from the file are reset to their default
+	if err := c.Reload(func(*Config) error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if *workers != 8 || *filter != "lanczos" || c.Presets != nil || *addr != "0.0.0.0:9000" {
+		t.Fatalf("unexpected settings after the reload: %d %s %v %s", *workers, *filter, c.Presets, *addr)
+	}
+}
@@ -7,8 +7,18 @@ import (
 	"io"
 )
 
+// buildTags are the build tags changing the behavior of the package.
+var buildTags = []string{}
+
 // Decode decodes an image that has been encoded in a registered format.
 func Decode(r io.Reader, _ string) (image.Image, error) {
 	img, _, err := image.Decode(r)
 	return img, err
 }
+
+// DecodeHint decodes an image that has been encoded in a registered format.
+// The pure Go JPEG decoder can't scale on decode, the image is returned at
+// its full size and the pyramid picks the intermediate sizes.
+func DecodeHint(r io.Reader, ext string, _ image.Point) (image.Image, error) {
+	return Decode(r, ext)
+}
@@ -0,0 +1,9 @@
+// +build !libjpegturbo
+
+package thumbnailer
+
+import "image"
+
+// decodeHintSize is the size pic.jpg is decoded at for the thumbnails of
+// Test_GenerateThumbnailsDecodeHint, the pure Go decoder can't scale it.
+var decodeHintSize = image.Pt(1632, 1224)
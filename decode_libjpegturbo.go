@@ -2,14 +2,90 @@
 
 package thumbnailer
 
+/*
+#cgo LDFLAGS: -ljpeg
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <setjmp.h>
+#include <jpeglib.h>
+
+struct thumb_error_mgr {
+	struct jpeg_error_mgr pub;
+	jmp_buf setjmp_buffer;
+	char msg[JMSG_LENGTH_MAX];
+};
+
+static void thumb_error_exit(j_common_ptr cinfo) {
+	struct thumb_error_mgr *err = (struct thumb_error_mgr *)cinfo->err;
+	(*cinfo->err->format_message)(cinfo, err->msg);
+	longjmp(err->setjmp_buffer, 1);
+}
+
+// thumb_decode_scaled decodes the JPEG image in buf at the scale 1/denom.
+// When out is NULL only the header is read and the size of the scaled image
+// is stored in width and height, otherwise the RGBA pixels are written to
+// out which must hold width * height * 4 bytes.
+static int thumb_decode_scaled(unsigned char *buf, unsigned long len, int denom,
+		unsigned char *out, int *width, int *height, char *msg) {
+	struct jpeg_decompress_struct cinfo;
+	struct thumb_error_mgr jerr;
+	JSAMPROW row;
+
+	cinfo.err = jpeg_std_error(&jerr.pub);
+	jerr.pub.error_exit = thumb_error_exit;
+	if (setjmp(jerr.setjmp_buffer)) {
+		strncpy(msg, jerr.msg, JMSG_LENGTH_MAX);
+		jpeg_destroy_decompress(&cinfo);
+		return -1;
+	}
+	jpeg_create_decompress(&cinfo);
+	jpeg_mem_src(&cinfo, buf, len);
+	jpeg_read_header(&cinfo, TRUE);
+	cinfo.scale_num = 1;
+	cinfo.scale_denom = denom;
+	cinfo.out_color_space = JCS_EXT_RGBA;
+
+	if (out == NULL) {
+		jpeg_calc_output_dimensions(&cinfo);
+		*width = cinfo.output_width;
+		*height = cinfo.output_height;
+		jpeg_destroy_decompress(&cinfo);
+		return 0;
+	}
+
+	jpeg_start_decompress(&cinfo);
+	if (cinfo.output_width != *width || cinfo.output_height != *height) {
+		snprintf(msg, JMSG_LENGTH_MAX, "unexpected scaled size %dx%d", cinfo.output_width, cinfo.output_height);
+		jpeg_destroy_decompress(&cinfo);
+		return -1;
+	}
+	while (cinfo.output_scanline < cinfo.output_height) {
+		row = out + (size_t)cinfo.output_scanline * cinfo.output_width * 4;
+		jpeg_read_scanlines(&cinfo, &row, 1);
+	}
+	jpeg_finish_decompress(&cinfo);
+	jpeg_destroy_decompress(&cinfo);
+	return 0;
+}
+*/
+import "C"
+
 import (
+	"bytes"
+	"errors"
 	"image"
 	"io"
+	"io/ioutil"
 	"strings"
+	"unsafe"
 
 	"github.com/kjk/golibjpegturbo"
 )
 
+// buildTags are the build tags changing the behavior of the package.
+var buildTags = []string{"libjpegturbo"}
+
 // Decode decodes an image that has been encoded in a registered format.
 func Decode(r io.Reader, ext string) (image.Image, error) {
 	ext = strings.ToLower(ext)
@@ -19,3 +95,55 @@ func Decode(r io.Reader, ext string) (image.Image, error) {
 	img, _, err := image.Decode(r)
 	return img, err
 }
+
+// DecodeHint decodes an image that has been encoded in a registered format.
+// JPEG images are decoded by libjpeg-turbo at the smallest of the 1/8, 1/4
+// and 1/2 scales keeping them at least as large as hint.
+func DecodeHint(r io.Reader, ext string, hint image.Point) (image.Image, error) {
+	if !isJPEG(ext) || (hint.X <= 0 && hint.Y <= 0) {
+		return Decode(r, ext)
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	width, height, err := decodeJPEGScaled(data, 1, nil)
+	if err != nil {
+		return golibjpegturbo.Decode(bytes.NewReader(data))
+	}
+	denom := scaleDenom(width, height, hint)
+	if denom == 1 {
+		return golibjpegturbo.Decode(bytes.NewReader(data))
+	}
+	width, height = scaledSize(width, height, denom)
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	if _, _, err := decodeJPEGScaled(data, denom, img); err != nil {
+		// Fall back to a full decode, e.g. for CMYK images
+		return golibjpegturbo.Decode(bytes.NewReader(data))
+	}
+	return img, nil
+}
+
+// decodeJPEGScaled decodes the JPEG image data at the scale 1/denom into img,
+// which must have the size of the scaled image. When img is nil only the
+// header is read. It returns the size of the scaled image.
+func decodeJPEGScaled(data []byte, denom int, img *image.NRGBA) (int, int, error) {
+	if len(data) == 0 {
+		return 0, 0, errors.New("Empty JPEG image")
+	}
+	var width, height C.int
+	var out *C.uchar
+	if img != nil {
+		width, height = C.int(img.Rect.Dx()), C.int(img.Rect.Dy())
+		out = (*C.uchar)(unsafe.Pointer(&img.Pix[0]))
+	}
+	msg := (*C.char)(C.malloc(C.JMSG_LENGTH_MAX))
+	defer C.free(unsafe.Pointer(msg))
+	ret := C.thumb_decode_scaled(
+		(*C.uchar)(unsafe.Pointer(&data[0])), C.ulong(len(data)), C.int(denom),
+		out, &width, &height, msg)
+	if ret != 0 {
+		return 0, 0, errors.New(C.GoString(msg))
+	}
+	return int(width), int(height), nil
+}
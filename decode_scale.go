@@ -0,0 +1,36 @@
+package thumbnailer
+
+import (
+	"image"
+	"strings"
+)
+
+// jpegScaleDenoms are the reductions applied by the DCT scaling of the JPEG
+// decoder, from the largest to the smallest.
+var jpegScaleDenoms = []int{8, 4, 2}
+
+func isJPEG(ext string) bool {
+	ext = strings.ToLower(ext)
+	return ext == ".jpg" || ext == ".jpeg"
+}
+
+// scaledSize returns the size of an image of width x height pixels decoded
+// at the scale 1/denom.
+func scaledSize(width, height, denom int) (int, int) {
+	return (width + denom - 1) / denom, (height + denom - 1) / denom
+}
+
+// scaleDenom returns the largest reduction keeping an image of width x height
+// pixels at least as large as hint, 1 when the image can't be reduced.
+func scaleDenom(width, height int, hint image.Point) int {
+	if hint.X <= 0 && hint.Y <= 0 {
+		return 1
+	}
+	for _, denom := range jpegScaleDenoms {
+		w, h := scaledSize(width, height, denom)
+		if w >= hint.X && h >= hint.Y {
+			return denom
+		}
+	}
+	return 1
+}
@@ -0,0 +1,9 @@
+// +build libjpegturbo
+
+package thumbnailer
+
+import "image"
+
+// decodeHintSize is the size pic.jpg is decoded at for the thumbnails of
+// Test_GenerateThumbnailsDecodeHint, libjpegturbo scales it on decode.
+var decodeHintSize = image.Pt(204, 153)
@@ -0,0 +1,268 @@
+package thumbnailer
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"image"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DiskCache is a read-through LRU cache of the source images on the local
+// disk, placed in front of a remote backend with its Storage method. The
+// images are keyed by their URL and the ETag, size and modification time
+// reported by the Stater of the backend, so a modified image is downloaded
+// again. The least recently used images are evicted once the cache exceeds
+// its size and the images older than its TTL are downloaded again.
+type DiskCache struct {
+	dir      string
+	maxBytes int64
+	ttl      time.Duration
+
+	mu      sync.Mutex
+	size    int64
+	lru     *list.List
+	entries map[string]*list.Element
+}
+
+type diskCacheEntry struct {
+	key     string
+	size    int64
+	created time.Time
+}
+
+const diskCacheTmpPrefix = ".tmp-"
+
+// NewDiskCache returns a DiskCache storing at most maxBytes in dir, the
+// images it already holds are kept, the least recently downloaded being the
+// first evicted. A zero ttl means no expiration.
+func NewDiskCache(dir string, maxBytes int64, ttl time.Duration) (*DiskCache, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	c := &DiskCache{dir: dir, maxBytes: maxBytes, ttl: ttl, lru: list.New(), entries: map[string]*list.Element{}}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].ModTime().Before(files[j].ModTime())
+	})
+	for _, fi := range files {
+		if strings.HasPrefix(fi.Name(), diskCacheTmpPrefix) {
+			// Left by an interrupted download
+			os.Remove(filepath.Join(dir, fi.Name()))
+			continue
+		}
+		if !fi.Mode().IsRegular() {
+			continue
+		}
+		c.insert(&diskCacheEntry{key: fi.Name(), size: fi.Size(), created: fi.ModTime()})
+	}
+	c.mu.Lock()
+	c.evict()
+	c.mu.Unlock()
+	return c, nil
+}
+
+// Storage returns a StorageFunc decorating the ImageOpenSaver of fn, their
+// images are read through the cache when they implement RawOpener and
+// Stater. The other operations are passed to them, and each of their
+// optional interfaces is kept.
+func (c *DiskCache) Storage(fn StorageFunc) StorageFunc {
+	return func(u *url.URL, codec *Codec) (ImageOpenSaver, error) {
+		s, err := fn(u, codec)
+		if err != nil {
+			return nil, err
+		}
+		_, rawOpener := s.(RawOpener)
+		_, stater := s.(Stater)
+		if !rawOpener || !stater {
+			return s, nil
+		}
+		return withInterfacesOf(cachedImageOpenSaver{ImageOpenSaver: s, URL: u, codec: codec, cache: c}, s), nil
+	}
+}
+
+// Size returns the number of bytes held by the cache.
+func (c *DiskCache) Size() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.size
+}
+
+// cacheKey returns the key of the image u described by info.
+func cacheKey(u *url.URL, info ImageInfo) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n%s\n%d\n%d", u, info.ETag, info.Size, info.ModTime.UnixNano())
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// open returns the cached image of key, or nil when it is missing or expired.
+func (c *DiskCache) open(key string) *os.File {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	entry := elem.Value.(*diskCacheEntry)
+	if c.ttl > 0 && time.Since(entry.created) > c.ttl {
+		c.remove(elem)
+		return nil
+	}
+	file, err := os.Open(filepath.Join(c.dir, key))
+	if err != nil {
+		c.remove(elem)
+		return nil
+	}
+	c.lru.MoveToFront(elem)
+	return file
+}
+
+// add moves the downloaded image tmp to the cache under key.
+func (c *DiskCache) add(key, tmp string, size int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := os.Rename(tmp, filepath.Join(c.dir, key)); err != nil {
+		os.Remove(tmp)
+		return
+	}
+	if elem, ok := c.entries[key]; ok {
+		c.size -= elem.Value.(*diskCacheEntry).size
+		c.lru.Remove(elem)
+		delete(c.entries, key)
+	}
+	c.insertLocked(&diskCacheEntry{key: key, size: size, created: time.Now()})
+	c.evict()
+}
+
+func (c *DiskCache) insert(entry *diskCacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.insertLocked(entry)
+}
+
+func (c *DiskCache) insertLocked(entry *diskCacheEntry) {
+	c.entries[entry.key] = c.lru.PushFront(entry)
+	c.size += entry.size
+}
+
+// evict removes the least recently used images until the cache fits in
+// maxBytes.
+func (c *DiskCache) evict() {
+	for c.maxBytes > 0 && c.size > c.maxBytes && c.lru.Len() > 0 {
+		c.remove(c.lru.Back())
+	}
+}
+
+func (c *DiskCache) remove(elem *list.Element) {
+	entry := elem.Value.(*diskCacheEntry)
+	c.lru.Remove(elem)
+	delete(c.entries, entry.key)
+	c.size -= entry.size
+	os.Remove(filepath.Join(c.dir, entry.key))
+}
+
+// cachedImageOpenSaver reads the image of an ImageOpenSaver through a
+// DiskCache, its other optional interfaces are only called when the
+// ImageOpenSaver implements them, see withInterfacesOf.
+type cachedImageOpenSaver struct {
+	ImageOpenSaver
+	URL   *url.URL
+	codec *Codec
+	cache *DiskCache
+}
+
+func (s cachedImageOpenSaver) OpenRaw() (io.ReadCloser, error) {
+	info, err := s.ImageOpenSaver.(Stater).Stat()
+	if err != nil {
+		return nil, err
+	}
+	key := cacheKey(s.URL, info)
+	if file := s.cache.open(key); file != nil {
+		return file, nil
+	}
+	r, err := s.ImageOpenSaver.(RawOpener).OpenRaw()
+	if err != nil {
+		return nil, err
+	}
+	tmp, err := ioutil.TempFile(s.cache.dir, diskCacheTmpPrefix)
+	if err != nil {
+		// The image is still readable without the cache
+		return r, nil
+	}
+	return &cacheFiller{ReadCloser: r, tmp: tmp, cache: s.cache, key: key}, nil
+}
+
+func (s cachedImageOpenSaver) Open() (image.Image, error) {
+	reader, err := s.OpenRaw()
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return s.codec.Decode(reader, filepath.Ext(s.URL.Path))
+}
+
+// Stat is not cached, it is needed to validate the cached images anyway.
+func (s cachedImageOpenSaver) Stat() (ImageInfo, error) {
+	return s.ImageOpenSaver.(Stater).Stat()
+}
+
+func (s cachedImageOpenSaver) SaveRaw(r io.Reader) error {
+	return s.ImageOpenSaver.(RawSaver).SaveRaw(r)
+}
+
+func (s cachedImageOpenSaver) SaveS3(r io.Reader, o S3Options) error {
+	return s.ImageOpenSaver.(S3Saver).SaveS3(r, o)
+}
+
+func (s cachedImageOpenSaver) Delete() error {
+	return s.ImageOpenSaver.(Deleter).Delete()
+}
+
+// cacheFiller copies the image it reads to a temporary file, added to the
+// cache when the image has been read entirely.
+type cacheFiller struct {
+	io.ReadCloser
+	tmp   *os.File
+	cache *DiskCache
+	key   string
+	size  int64
+	eof   bool
+	err   error
+}
+
+func (f *cacheFiller) Read(p []byte) (int, error) {
+	n, err := f.ReadCloser.Read(p)
+	if n > 0 && f.err == nil {
+		_, f.err = f.tmp.Write(p[:n])
+		f.size += int64(n)
+	}
+	if err == io.EOF {
+		f.eof = true
+	}
+	return n, err
+}
+
+func (f *cacheFiller) Close() error {
+	err := f.ReadCloser.Close()
+	if cerr := f.tmp.Close(); f.err == nil {
+		f.err = cerr
+	}
+	if f.eof && f.err == nil {
+		f.cache.add(f.key, f.tmp.Name(), f.size)
+	} else {
+		os.Remove(f.tmp.Name())
+	}
+	return err
+}
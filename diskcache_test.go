@@ -0,0 +1,150 @@
+package thumbnailer
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gopkg.in/amz.v1/aws"
+)
+
+// countingImageOpenSaver counts the images read from a MemStorage.
+type countingImageOpenSaver struct {
+	memImageOpenSaver
+	reads *int
+}
+
+func (s countingImageOpenSaver) OpenRaw() (io.ReadCloser, error) {
+	*s.reads++
+	return s.memImageOpenSaver.OpenRaw()
+}
+
+func Test_DiskCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "thumbnailer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	m := NewMemStorage()
+	var reads int
+	remote := func(u *url.URL, c *Codec) (ImageOpenSaver, error) {
+		return countingImageOpenSaver{memImageOpenSaver{URL: u, codec: c, storage: m}, &reads}, nil
+	}
+	cache, err := NewDiskCache(dir, 10, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage := cache.Storage(remote)
+	read := func(rawURL string) string {
+		u, _ := url.Parse(rawURL)
+		s, err := storage(u, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, err := s.(RawOpener).OpenRaw()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+		data, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(data)
+	}
+
+	m.Put("bucket/a.jpg", []byte("aaaaaa"))
+	if read("mem://bucket/a.jpg") != "aaaaaa" || read("mem://bucket/a.jpg") != "aaaaaa" || reads != 1 {
+		t.Fatalf("expected a single read of the remote image, got %d", reads)
+	}
+
+	// A modified image is read again
+	m.Put("bucket/a.jpg", []byte("aaaaaaa"))
+	if read("mem://bucket/a.jpg") != "aaaaaaa" || reads != 2 {
+		t.Fatalf("expected the modified image to be read again, got %d reads", reads)
+	}
+
+	// b.jpg does not fit next to a.jpg, which is evicted
+	m.Put("bucket/b.jpg", []byte("bbbbbb"))
+	read("mem://bucket/b.jpg")
+	if size := cache.Size(); size != 6 {
+		t.Fatalf("got: %d cached bytes, expected: 6", size)
+	}
+	read("mem://bucket/a.jpg")
+	if reads != 4 {
+		t.Fatalf("expected the evicted image to be read again, got %d reads", reads)
+	}
+
+	// The cached images are kept by a new DiskCache
+	cache, err = NewDiskCache(dir, 10, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage = cache.Storage(remote)
+	read("mem://bucket/a.jpg")
+	if reads != 4 {
+		t.Fatalf("expected the image to be read from the disk, got %d reads", reads)
+	}
+}
+
+func Test_DiskCacheInterfaces(t *testing.T) {
+	dir, err := ioutil.TempDir("", "thumbnailer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cache, err := NewDiskCache(dir, 10, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, _ := url.Parse("s3://bucket/pic.jpg")
+	s, err := cache.Storage(Retry(context.Background(), S3Storage(aws.Auth{}, aws.USEast, S3Options{}), DefaultRetryPolicy))(u, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.(cachedImageOpenSaver); ok {
+		t.Fatal("expected the optional interfaces to be restricted")
+	}
+	_, rawOpener := s.(RawOpener)
+	_, rawSaver := s.(RawSaver)
+	_, s3Saver := s.(S3Saver)
+	_, stater := s.(Stater)
+	_, deleter := s.(Deleter)
+	if !rawOpener || !rawSaver || !s3Saver || !stater || deleter {
+		t.Fatalf("expected %T to keep the optional interfaces of the S3 storage", s)
+	}
+}
+
+func Test_NewDiskCacheOrder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "thumbnailer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// "new" is listed first but downloaded last
+	for name, age := range map[string]time.Duration{"new": time.Hour, "old": 2 * time.Hour} {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte("abc"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		modTime := time.Now().Add(-age)
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := NewDiskCache(dir, 4, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "old")); !os.IsNotExist(err) {
+		t.Fatalf("expected the oldest image to be evicted, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "new")); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -6,15 +6,32 @@ import (
 	"image/jpeg"
 	"image/png"
 	"io"
+	"strings"
 
 	"github.com/disintegration/imaging"
 	"golang.org/x/image/bmp"
 	"golang.org/x/image/tiff"
 )
 
-// Encode writes the image img to w in the specified format (JPEG, PNG, GIF, TIFF or BMP).
-// copied from `imaging` and modified
+// EncodeOptions holds the settings used by the encoders.
+type EncodeOptions struct {
+	// JPEGQuality ranges from 1 to 100 inclusive, higher is better.
+	JPEGQuality int
+	// GIFNumColors is the maximum number of colors used in a GIF image, from 1 to 256.
+	GIFNumColors int
+}
+
+var defaultEncodeOptions = EncodeOptions{JPEGQuality: 75, GIFNumColors: 256}
+
+// Encode writes the image img to w in the specified format (JPEG, PNG, GIF, TIFF or BMP)
+// using the default EncodeOptions.
 func Encode(w io.Writer, img image.Image, format imaging.Format) error {
+	return EncodeWithOptions(w, img, format, defaultEncodeOptions)
+}
+
+// EncodeWithOptions writes the image img to w in the specified format (JPEG, PNG, GIF, TIFF or BMP).
+// copied from `imaging` and modified
+func EncodeWithOptions(w io.Writer, img image.Image, format imaging.Format, opts EncodeOptions) error {
 	var err error
 	switch format {
 	case imaging.JPEG:
@@ -29,15 +46,15 @@ func Encode(w io.Writer, img image.Image, format imaging.Format) error {
 			}
 		}
 		if rgba != nil {
-			err = jpeg.Encode(w, rgba, &jpeg.Options{Quality: 75})
+			err = jpeg.Encode(w, rgba, &jpeg.Options{Quality: opts.JPEGQuality})
 		} else {
-			err = jpeg.Encode(w, img, &jpeg.Options{Quality: 75})
+			err = jpeg.Encode(w, img, &jpeg.Options{Quality: opts.JPEGQuality})
 		}
 
 	case imaging.PNG:
 		err = png.Encode(w, img)
 	case imaging.GIF:
-		err = gif.Encode(w, img, &gif.Options{NumColors: 256})
+		err = gif.Encode(w, img, &gif.Options{NumColors: opts.GIFNumColors})
 	case imaging.TIFF:
 		err = tiff.Encode(w, img, &tiff.Options{Compression: tiff.Deflate, Predictor: true})
 	case imaging.BMP:
@@ -47,3 +64,51 @@ func Encode(w io.Writer, img image.Image, format imaging.Format) error {
 	}
 	return err
 }
+
+// Codec decodes and encodes images according to their file extension.
+type Codec struct {
+	// Formats maps a lower case file extension (".jpg") to its format.
+	Formats map[string]imaging.Format
+	Options EncodeOptions
+}
+
+func defaultFormats() map[string]imaging.Format {
+	return map[string]imaging.Format{
+		".jpg":  imaging.JPEG,
+		".jpeg": imaging.JPEG,
+		".png":  imaging.PNG,
+		".tif":  imaging.TIFF,
+		".tiff": imaging.TIFF,
+		".bmp":  imaging.BMP,
+		".gif":  imaging.GIF,
+	}
+}
+
+// Format returns the format registered for ext.
+func (c *Codec) Format(ext string) (imaging.Format, error) {
+	f, ok := c.Formats[strings.ToLower(ext)]
+	if !ok {
+		return 0, imaging.ErrUnsupportedFormat
+	}
+	return f, nil
+}
+
+// Encode writes img to w in the format registered for ext.
+func (c *Codec) Encode(w io.Writer, img image.Image, ext string) error {
+	f, err := c.Format(ext)
+	if err != nil {
+		return err
+	}
+	return EncodeWithOptions(w, img, f, c.Options)
+}
+
+// Decode decodes an image read from r, ext is the file extension of the image.
+func (c *Codec) Decode(r io.Reader, ext string) (image.Image, error) {
+	return Decode(r, ext)
+}
+
+// DecodeHint decodes an image read from r, it may be downscaled on decode
+// while staying at least as large as hint.
+func (c *Codec) DecodeHint(r io.Reader, ext string, hint image.Point) (image.Image, error) {
+	return DecodeHint(r, ext, hint)
+}
@@ -0,0 +1,47 @@
+package thumbnailer
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/disintegration/imaging"
+)
+
+// Filter is the name of a resampling filter used to resize the images.
+type Filter string
+
+// Supported resampling filters.
+const (
+	Lanczos           Filter = "lanczos"
+	CatmullRom        Filter = "catmullrom"
+	Linear            Filter = "linear"
+	Box               Filter = "box"
+	NearestNeighbor   Filter = "nearestneighbor"
+	MitchellNetravali Filter = "mitchellnetravali"
+)
+
+// DefaultFilter is the filter used when neither the ThumbnailOpt nor the
+// Thumbnailer specify one. It does not appear in the thumbnail names.
+const DefaultFilter = CatmullRom
+
+var resampleFilters = map[Filter]imaging.ResampleFilter{
+	Lanczos:           imaging.Lanczos,
+	CatmullRom:        imaging.CatmullRom,
+	Linear:            imaging.Linear,
+	Box:               imaging.Box,
+	NearestNeighbor:   imaging.NearestNeighbor,
+	MitchellNetravali: imaging.MitchellNetravali,
+}
+
+// ParseFilter returns the Filter named s, the comparison is case insensitive.
+func ParseFilter(s string) (Filter, error) {
+	f := Filter(strings.ToLower(s))
+	if _, ok := resampleFilters[f]; !ok {
+		return "", fmt.Errorf("Unsupported resampling filter: %q", s)
+	}
+	return f, nil
+}
+
+func (f Filter) resampleFilter() imaging.ResampleFilter {
+	return resampleFilters[f]
+}
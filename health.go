@@ -0,0 +1,67 @@
+package thumbnailer
+
+import (
+	"errors"
+	"net/url"
+	"os"
+	"runtime"
+	"sort"
+	"strings"
+)
+
+// BuildInfo describes the build of the package and the formats supported
+// by a Thumbnailer.
+type BuildInfo struct {
+	Version   string   `json:"version"`
+	GoVersion string   `json:"goVersion"`
+	BuildTags []string `json:"buildTags"`
+	Formats   []string `json:"formats"`
+}
+
+// BuildInfo returns the BuildInfo of the Thumbnailer, the formats are the
+// extensions it encodes and decodes without their dot.
+func (t *Thumbnailer) BuildInfo() BuildInfo {
+	formats := make([]string, 0, len(t.codec.Formats))
+	for ext := range t.codec.Formats {
+		formats = append(formats, strings.TrimPrefix(ext, "."))
+	}
+	sort.Strings(formats)
+	return BuildInfo{
+		Version:   Version,
+		GoVersion: runtime.Version(),
+		BuildTags: buildTags,
+		Formats:   formats,
+	}
+}
+
+// Load returns the number of thumbnails being generated and the maximum set
+// by WithWorkers, 0 when there is no maximum.
+func (t *Thumbnailer) Load() (busy, capacity int) {
+	return len(t.workers), cap(t.workers)
+}
+
+// ErrStorageUnchecked is returned by CheckStorage for the backends which
+// are not Staters, they can't be checked.
+var ErrStorageUnchecked = errors.New("The storage can't be checked")
+
+// CheckStorage tells if the backend of the folder folderURL is reachable,
+// with the Stat of the folder. A missing folder is reachable, the backends
+// which are not Staters return ErrStorageUnchecked.
+func (t *Thumbnailer) CheckStorage(folderURL string) error {
+	u, err := url.Parse(folderURL)
+	if err != nil {
+		return err
+	}
+	s, err := t.NewImageOpenSaver(u)
+	if err != nil {
+		return err
+	}
+	stater, ok := s.(Stater)
+	if !ok {
+		return ErrStorageUnchecked
+	}
+	if _, err := stater.Stat(); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
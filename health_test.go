@@ -0,0 +1,77 @@
+package thumbnailer
+
+import (
+	"errors"
+	"image"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+// failingImageOpenSaver fails its Stat with err.
+type failingImageOpenSaver struct {
+	err error
+}
+
+func (s failingImageOpenSaver) Open() (image.Image, error) {
+	return nil, s.err
+}
+
+func (s failingImageOpenSaver) Save(img image.Image) error {
+	return s.err
+}
+
+func (s failingImageOpenSaver) Stat() (ImageInfo, error) {
+	return ImageInfo{}, s.err
+}
+
+func Test_BuildInfo(t *testing.T) {
+	info := New().BuildInfo()
+	expected := []string{"bmp", "gif", "jpeg", "jpg", "png", "tif", "tiff"}
+	if info.Version != Version || !reflect.DeepEqual(info.Formats, expected) {
+		t.Fatalf("unexpected build info: %+v", info)
+	}
+	if busy, capacity := New(WithWorkers(3)).Load(); busy != 0 || capacity != 3 {
+		t.Fatalf("got a load of %d/%d, expected 0/3", busy, capacity)
+	}
+}
+
+func Test_CheckStorage(t *testing.T) {
+	down := errors.New("connection refused")
+	th := New(
+		WithStorage("mem", NewMemStorage().Storage),
+		WithStorage("down", func(u *url.URL, c *Codec) (ImageOpenSaver, error) {
+			return failingImageOpenSaver{err: down}, nil
+		}),
+	)
+	// A missing folder is reachable
+	if err := th.CheckStorage("mem://bucket/thumbs"); err != nil {
+		t.Fatal(err)
+	}
+	if err := th.CheckStorage("down://bucket/thumbs"); err != down {
+		t.Fatalf("expected %v, got %v", down, err)
+	}
+	if err := th.CheckStorage("unknown://bucket/thumbs"); err == nil {
+		t.Fatal("expected an error for the unknown scheme")
+	}
+	var calls int
+	th = New(WithStorage("flaky", func(u *url.URL, c *Codec) (ImageOpenSaver, error) {
+		return flakyImageOpenSaver{calls: &calls}, nil
+	}))
+	if err := th.CheckStorage("flaky://bucket/thumbs"); err != ErrStorageUnchecked {
+		t.Fatalf("expected %v, got %v", ErrStorageUnchecked, err)
+	}
+}
+
+func Test_CheckStorageS3(t *testing.T) {
+	srv := httptest.NewServer(newFakeS3())
+	th := New(WithStorage("s3", s3Stack(t, srv)))
+	if err := th.CheckStorage("s3://bucket/thumbs"); err != nil {
+		t.Fatal(err)
+	}
+	srv.Close()
+	if err := th.CheckStorage("s3://bucket/thumbs"); err == nil {
+		t.Fatal("expected an error once S3 is down")
+	}
+}
@@ -4,6 +4,7 @@ package thumbnailer
 
 import (
 	"fmt"
+	"image"
 	"os"
 	"path/filepath"
 	"testing"
@@ -13,11 +14,32 @@ func TestDecodelibJpegTurbo(t *testing.T) {
 	img := "sof-issue-supported-by-libjpegturbo.jpg"
 	pwd, err := os.Getwd()
 	if err != nil {
-		t.Fatal("Failed to get the current directory: %s", err)
+		t.Fatalf("Failed to get the current directory: %s", err)
 	}
 	fmt.Println("Current dir:", pwd)
 
-	file, err := os.Open(filepath.Join(pwd, img))
+	file, err := os.Open(filepath.Join(pwd, "testdata", img))
+	if err != nil {
+		t.Fatal(err)
+	}
 	defer file.Close()
-	Decode(file, filepath.Ext(img))
+	if _, err := Decode(file, filepath.Ext(img)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDecodeHintlibJpegTurbo(t *testing.T) {
+	file, err := os.Open(filepath.Join("testdata", "pic.jpg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	img, err := DecodeHint(file, ".jpg", image.Pt(300, 200))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 1632x1224 decoded at 1/4
+	if size := img.Bounds().Size(); size != image.Pt(408, 306) {
+		t.Fatalf("got: %v, expected: 408x306", size)
+	}
 }
@@ -0,0 +1,167 @@
+package thumbnailer
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemStorage keeps images in memory, it is meant to test the code using
+// the Thumbnailer without touching the disk or the network:
+//
+//	m := thumbnailer.NewMemStorage()
+//	m.Put("bucket/src.jpg", data)
+//	t := thumbnailer.New(thumbnailer.WithStorage("mem", m.Storage))
+//	t.Process(&thumbnailer.ThumbnailerMessage{SrcImage: "mem://bucket/src.jpg", ...})
+//
+// The images are stored under the host and the path of their URL,
+// "bucket/src.jpg" above. A MemStorage is safe for concurrent use.
+type MemStorage struct {
+	mu      sync.RWMutex
+	objects map[string]memObject
+}
+
+type memObject struct {
+	data    []byte
+	modTime time.Time
+}
+
+// NewMemStorage returns an empty MemStorage.
+func NewMemStorage() *MemStorage {
+	return &MemStorage{objects: map[string]memObject{}}
+}
+
+// Storage is the StorageFunc of m, usually registered for the mem:// scheme.
+func (m *MemStorage) Storage(u *url.URL, c *Codec) (ImageOpenSaver, error) {
+	return &memImageOpenSaver{URL: u, codec: c, storage: m}, nil
+}
+
+// Put stores data under key.
+func (m *MemStorage) Put(key string, data []byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.objects[key] = memObject{data: append([]byte(nil), data...), modTime: time.Now()}
+}
+
+// Bytes returns the bytes stored under key.
+func (m *MemStorage) Bytes(key string) ([]byte, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	o, ok := m.objects[key]
+	if !ok {
+		return nil, false
+	}
+	return append([]byte(nil), o.data...), true
+}
+
+// Keys returns the sorted keys of the stored images.
+func (m *MemStorage) Keys() []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	keys := make([]string, 0, len(m.objects))
+	for k := range m.objects {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Size returns the dimensions of the image stored under key.
+func (m *MemStorage) Size(key string) (image.Point, error) {
+	data, ok := m.Bytes(key)
+	if !ok {
+		return image.Point{}, m.notExist("stat", key)
+	}
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return image.Point{}, fmt.Errorf("Failed to decode the size of %s: %s", key, err)
+	}
+	return image.Pt(config.Width, config.Height), nil
+}
+
+// Delete removes the image stored under key.
+func (m *MemStorage) Delete(key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.objects[key]; !ok {
+		return m.notExist("remove", key)
+	}
+	delete(m.objects, key)
+	return nil
+}
+
+func (m *MemStorage) stat(key string) (ImageInfo, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	o, ok := m.objects[key]
+	if !ok {
+		return ImageInfo{}, m.notExist("stat", key)
+	}
+	return ImageInfo{Size: int64(len(o.data)), ModTime: o.modTime}, nil
+}
+
+func (m *MemStorage) notExist(op, key string) error {
+	return &os.PathError{Op: op, Path: "mem://" + key, Err: os.ErrNotExist}
+}
+
+// in-memory implementation of the ImageOpenSaver interface
+type memImageOpenSaver struct {
+	URL     *url.URL
+	codec   *Codec
+	storage *MemStorage
+}
+
+func (s memImageOpenSaver) key() string {
+	return s.URL.Host + s.URL.Path
+}
+
+func (s memImageOpenSaver) OpenRaw() (io.ReadCloser, error) {
+	data, ok := s.storage.Bytes(s.key())
+	if !ok {
+		return nil, s.storage.notExist("open", s.key())
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (s memImageOpenSaver) Open() (image.Image, error) {
+	reader, err := s.OpenRaw()
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return s.codec.Decode(reader, filepath.Ext(s.URL.Path))
+}
+
+func (s memImageOpenSaver) Save(img image.Image) error {
+	var buffer bytes.Buffer
+	if err := s.codec.Encode(&buffer, img, filepath.Ext(s.URL.Path)); err != nil {
+		return err
+	}
+	s.storage.Put(s.key(), buffer.Bytes())
+	return nil
+}
+
+func (s memImageOpenSaver) SaveRaw(r io.Reader) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	s.storage.Put(s.key(), data)
+	return nil
+}
+
+func (s memImageOpenSaver) Stat() (ImageInfo, error) {
+	return s.storage.stat(s.key())
+}
+
+func (s memImageOpenSaver) Delete() error {
+	return s.storage.Delete(s.key())
+}
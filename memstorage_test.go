@@ -0,0 +1,57 @@
+package thumbnailer
+
+import (
+	"image"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func Test_MemStorage(t *testing.T) {
+	data, err := ioutil.ReadFile(filepath.Join("testdata", "pic.jpg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := NewMemStorage()
+	m.Put("bucket/pic.jpg", data)
+	th := New(WithStorage("mem", m.Storage))
+	tm := ThumbnailerMessage{
+		SrcImage:  "mem://bucket/pic.jpg",
+		DstFolder: "mem://bucket/thumbs",
+		Opts:      []ThumbnailOpt{{Width: 100}, {Width: 50, Height: 50}},
+		Overwrite: OverwriteNever,
+	}
+	if _, err := th.Process(&tm); err != nil {
+		t.Fatal("An error occured while generating the thumbs :", err)
+	}
+	expected := []string{"bucket/pic.jpg", "bucket/thumbs/pic_s100x75.jpg", "bucket/thumbs/pic_s50x50.jpg"}
+	if keys := m.Keys(); !reflect.DeepEqual(keys, expected) {
+		t.Fatalf("got: %v, expected: %v", keys, expected)
+	}
+	if size, err := m.Size("bucket/thumbs/pic_s100x75.jpg"); err != nil || size != image.Pt(100, 75) {
+		t.Fatalf("got: %v %v, expected: 100x75", size, err)
+	}
+
+	// The existing thumbnails are found by Stat
+	results, err := th.Process(&tm)
+	if err != nil {
+		t.Fatal("An error occured while generating the thumbs :", err)
+	}
+	for _, r := range results {
+		if !r.Skipped {
+			t.Fatalf("expected %s to be skipped", r.Thumbnail)
+		}
+	}
+
+	if err := th.DeleteImage(&tm); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := m.Bytes("bucket/pic.jpg"); ok {
+		t.Fatal("expected the source to be deleted")
+	}
+	if _, err := m.Size("bucket/pic.jpg"); !os.IsNotExist(err) {
+		t.Fatalf("expected a not exist error, got %v", err)
+	}
+}
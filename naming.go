@@ -0,0 +1,139 @@
+package thumbnailer
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// DefaultNameTemplate is the template used to name the thumbnails when
+// neither the ThumbnailerMessage nor the Thumbnailer specify one.
+const DefaultNameTemplate = "{dir}/{name}{crop}_s{w}x{h}{filter}.{ext}"
+
+// NameTemplatePresets are the templates that can be referred to by name.
+var NameTemplatePresets = map[string]string{
+	"default": DefaultNameTemplate,
+	"folder":  "{dir}/{name}/{w}x{h}{mode}.{ext}",
+	"hashed":  "{dir}/{name}_{hash}.{ext}",
+	"content": "{dir}/{shard}/{srchash}_{w}x{h}{mode}.{ext}",
+}
+
+// namePlaceholders are the placeholders supported in the name templates:
+//
+//	{dir}     the path of the DstFolder
+//	{name}    the name of the source image without its extension
+//	{ext}     the lower case extension of the source image, without the dot
+//	{w}, {h}  the size of the thumbnail
+//	{crop}    "_c<minX>-<minY>-<maxX>-<maxY>" when the thumbnail has a rect
+//	{filter}  "_<filter>" when the filter is not the DefaultFilter
+//	{mode}    {crop}{filter}
+//	{hash}    a hash of the source image URL and of the ThumbnailOpt
+//	{srchash} the SHA-256 of the source image bytes
+//	{shard}   "<ab>/<cd>", the first two bytes of {srchash}
+//
+// The names built with {srchash} only depend on the content of the source
+// image, so identical images share their thumbnails.
+var namePlaceholders = map[string]bool{
+	"dir": true, "name": true, "ext": true, "w": true, "h": true,
+	"crop": true, "filter": true, "mode": true, "hash": true,
+	"srchash": true, "shard": true,
+}
+
+// emptyPlaceholders are the placeholders which may be replaced by nothing.
+var emptyPlaceholders = map[string]bool{"{crop}": true, "{filter}": true, "{mode}": true}
+
+var placeholderRe = regexp.MustCompile(`\{([^{}]*)\}`)
+
+// ParseNameTemplate returns the template named s, or s itself when it is
+// not the name of a preset, after checking its placeholders. The template
+// must start with "{dir}/" and can not have "." or ".." segments, so that
+// the thumbnails stay in their DstFolder.
+func ParseNameTemplate(s string) (string, error) {
+	if s == "" {
+		s = DefaultNameTemplate
+	}
+	if preset, ok := NameTemplatePresets[s]; ok {
+		s = preset
+	}
+	for _, m := range placeholderRe.FindAllStringSubmatch(s, -1) {
+		if !namePlaceholders[m[1]] {
+			return "", fmt.Errorf("Unsupported placeholder %s in the name template %q", m[0], s)
+		}
+	}
+	if strings.ContainsAny(placeholderRe.ReplaceAllString(s, ""), "{}") {
+		return "", fmt.Errorf("Unbalanced braces in the name template %q", s)
+	}
+	if !strings.Contains(s, "{") {
+		return "", fmt.Errorf("The name template %q has no placeholder", s)
+	}
+	if !strings.HasPrefix(s, "{dir}/") {
+		return "", fmt.Errorf("The name template %q does not start with {dir}/", s)
+	}
+	// {crop}, {filter} and {mode} may be empty, "..{crop}" can be ".." while
+	// "{name}.{ext}" can't be "."
+	for _, segment := range strings.Split(s, "/") {
+		literal := placeholderRe.ReplaceAllStringFunc(segment, func(p string) string {
+			if emptyPlaceholders[p] {
+				return ""
+			}
+			return "x"
+		})
+		if literal == "." || literal == ".." {
+			return "", fmt.Errorf("The name template %q leaves its {dir}", s)
+		}
+	}
+	return s, nil
+}
+
+// needsSourceHash tells if the names built from tmpl depend on the content
+// of the source image.
+func needsSourceHash(tmpl string) bool {
+	return strings.Contains(tmpl, "{srchash}") || strings.Contains(tmpl, "{shard}")
+}
+
+// optHash returns a hash identifying the thumbnail of opt made from srcImage.
+func optHash(srcImage string, opt ThumbnailOpt) string {
+	h := sha1.New()
+	fmt.Fprintf(h, "%s\n%dx%d\n%s", srcImage, opt.Width, opt.Height, opt.Filter)
+	if opt.Rect != nil {
+		fmt.Fprintf(h, "\n%v", *opt.Rect)
+	}
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+// thumbName returns the path of the thumbnail of opt built from tmpl, dir is
+// the path of the destination folder and srcHash the hash of the source image.
+func (tm *ThumbnailerMessage) thumbName(tmpl, dir, srcHash string, opt ThumbnailOpt) string {
+	ext := filepath.Ext(tm.SrcImage)
+	name := strings.TrimSuffix(filepath.Base(tm.SrcImage), ext)
+	var crop, filter, shard string
+	if opt.Rect != nil {
+		crop = fmt.Sprintf("_c%d-%d-%d-%d", opt.Rect.Min[0], opt.Rect.Min[1], opt.Rect.Max[0], opt.Rect.Max[1])
+	}
+	// The filter is only part of the name when it is not the default one
+	if opt.Filter != "" && opt.Filter != DefaultFilter {
+		filter = "_" + string(opt.Filter)
+	}
+	if len(srcHash) >= 4 {
+		shard = srcHash[:2] + "/" + srcHash[2:4]
+	}
+	r := strings.NewReplacer(
+		"{dir}", dir,
+		"{name}", name,
+		"{ext}", strings.TrimPrefix(strings.ToLower(ext), "."),
+		"{w}", strconv.Itoa(opt.Width),
+		"{h}", strconv.Itoa(opt.Height),
+		"{crop}", crop,
+		"{filter}", filter,
+		"{mode}", crop+filter,
+		"{hash}", optHash(tm.SrcImage, opt),
+		"{srchash}", srcHash,
+		"{shard}", shard,
+	)
+	return path.Clean(r.Replace(tmpl))
+}
@@ -0,0 +1,253 @@
+package thumbnailer
+
+// optionalImageOpenSaver is implemented by the decorators of the
+// ImageOpenSaver implementing all the optional interfaces, see
+// withInterfacesOf.
+type optionalImageOpenSaver interface {
+	ImageOpenSaver
+	RawOpener
+	RawSaver
+	S3Saver
+	Stater
+	Deleter
+}
+
+// The optional interfaces implemented by an ImageOpenSaver.
+const (
+	hasRawOpener = 1 << iota
+	hasRawSaver
+	hasS3Saver
+	hasStater
+	hasDeleter
+)
+
+// withInterfacesOf returns the decorator s of inner restricted to the
+// optional interfaces implemented by inner, each of them is kept
+// independently of the others. The callers rely on type assertions to find
+// the optional interfaces, so a decorator must neither hide the ones of
+// inner nor claim the ones inner lacks.
+func withInterfacesOf(s optionalImageOpenSaver, inner ImageOpenSaver) ImageOpenSaver {
+	var has int
+	if _, ok := inner.(RawOpener); ok {
+		has |= hasRawOpener
+	}
+	if _, ok := inner.(RawSaver); ok {
+		has |= hasRawSaver
+	}
+	if _, ok := inner.(S3Saver); ok {
+		has |= hasS3Saver
+	}
+	if _, ok := inner.(Stater); ok {
+		has |= hasStater
+	}
+	if _, ok := inner.(Deleter); ok {
+		has |= hasDeleter
+	}
+	switch has {
+	case hasRawOpener:
+		return struct {
+			ImageOpenSaver
+			RawOpener
+		}{s, s}
+	case hasRawSaver:
+		return struct {
+			ImageOpenSaver
+			RawSaver
+		}{s, s}
+	case hasRawOpener | hasRawSaver:
+		return struct {
+			ImageOpenSaver
+			RawOpener
+			RawSaver
+		}{s, s, s}
+	case hasS3Saver:
+		return struct {
+			ImageOpenSaver
+			S3Saver
+		}{s, s}
+	case hasRawOpener | hasS3Saver:
+		return struct {
+			ImageOpenSaver
+			RawOpener
+			S3Saver
+		}{s, s, s}
+	case hasRawSaver | hasS3Saver:
+		return struct {
+			ImageOpenSaver
+			RawSaver
+			S3Saver
+		}{s, s, s}
+	case hasRawOpener | hasRawSaver | hasS3Saver:
+		return struct {
+			ImageOpenSaver
+			RawOpener
+			RawSaver
+			S3Saver
+		}{s, s, s, s}
+	case hasStater:
+		return struct {
+			ImageOpenSaver
+			Stater
+		}{s, s}
+	case hasRawOpener | hasStater:
+		return struct {
+			ImageOpenSaver
+			RawOpener
+			Stater
+		}{s, s, s}
+	case hasRawSaver | hasStater:
+		return struct {
+			ImageOpenSaver
+			RawSaver
+			Stater
+		}{s, s, s}
+	case hasRawOpener | hasRawSaver | hasStater:
+		return struct {
+			ImageOpenSaver
+			RawOpener
+			RawSaver
+			Stater
+		}{s, s, s, s}
+	case hasS3Saver | hasStater:
+		return struct {
+			ImageOpenSaver
+			S3Saver
+			Stater
+		}{s, s, s}
+	case hasRawOpener | hasS3Saver | hasStater:
+		return struct {
+			ImageOpenSaver
+			RawOpener
+			S3Saver
+			Stater
+		}{s, s, s, s}
+	case hasRawSaver | hasS3Saver | hasStater:
+		return struct {
+			ImageOpenSaver
+			RawSaver
+			S3Saver
+			Stater
+		}{s, s, s, s}
+	case hasRawOpener | hasRawSaver | hasS3Saver | hasStater:
+		return struct {
+			ImageOpenSaver
+			RawOpener
+			RawSaver
+			S3Saver
+			Stater
+		}{s, s, s, s, s}
+	case hasDeleter:
+		return struct {
+			ImageOpenSaver
+			Deleter
+		}{s, s}
+	case hasRawOpener | hasDeleter:
+		return struct {
+			ImageOpenSaver
+			RawOpener
+			Deleter
+		}{s, s, s}
+	case hasRawSaver | hasDeleter:
+		return struct {
+			ImageOpenSaver
+			RawSaver
+			Deleter
+		}{s, s, s}
+	case hasRawOpener | hasRawSaver | hasDeleter:
+		return struct {
+			ImageOpenSaver
+			RawOpener
+			RawSaver
+			Deleter
+		}{s, s, s, s}
+	case hasS3Saver | hasDeleter:
+		return struct {
+			ImageOpenSaver
+			S3Saver
+			Deleter
+		}{s, s, s}
+	case hasRawOpener | hasS3Saver | hasDeleter:
+		return struct {
+			ImageOpenSaver
+			RawOpener
+			S3Saver
+			Deleter
+		}{s, s, s, s}
+	case hasRawSaver | hasS3Saver | hasDeleter:
+		return struct {
+			ImageOpenSaver
+			RawSaver
+			S3Saver
+			Deleter
+		}{s, s, s, s}
+	case hasRawOpener | hasRawSaver | hasS3Saver | hasDeleter:
+		return struct {
+			ImageOpenSaver
+			RawOpener
+			RawSaver
+			S3Saver
+			Deleter
+		}{s, s, s, s, s}
+	case hasStater | hasDeleter:
+		return struct {
+			ImageOpenSaver
+			Stater
+			Deleter
+		}{s, s, s}
+	case hasRawOpener | hasStater | hasDeleter:
+		return struct {
+			ImageOpenSaver
+			RawOpener
+			Stater
+			Deleter
+		}{s, s, s, s}
+	case hasRawSaver | hasStater | hasDeleter:
+		return struct {
+			ImageOpenSaver
+			RawSaver
+			Stater
+			Deleter
+		}{s, s, s, s}
+	case hasRawOpener | hasRawSaver | hasStater | hasDeleter:
+		return struct {
+			ImageOpenSaver
+			RawOpener
+			RawSaver
+			Stater
+			Deleter
+		}{s, s, s, s, s}
+	case hasS3Saver | hasStater | hasDeleter:
+		return struct {
+			ImageOpenSaver
+			S3Saver
+			Stater
+			Deleter
+		}{s, s, s, s}
+	case hasRawOpener | hasS3Saver | hasStater | hasDeleter:
+		return struct {
+			ImageOpenSaver
+			RawOpener
+			S3Saver
+			Stater
+			Deleter
+		}{s, s, s, s, s}
+	case hasRawSaver | hasS3Saver | hasStater | hasDeleter:
+		return struct {
+			ImageOpenSaver
+			RawSaver
+			S3Saver
+			Stater
+			Deleter
+		}{s, s, s, s, s}
+	case hasRawOpener | hasRawSaver | hasS3Saver | hasStater | hasDeleter:
+		return struct {
+			ImageOpenSaver
+			RawOpener
+			RawSaver
+			S3Saver
+			Stater
+			Deleter
+		}{s, s, s, s, s, s}
+	}
+	return struct{ ImageOpenSaver }{s}
+}
@@ -0,0 +1,115 @@
+package thumbnailer
+
+import (
+	"log"
+	"strings"
+	"time"
+
+	"github.com/disintegration/imaging"
+)
+
+// Option configures a Thumbnailer.
+type Option func(*Thumbnailer)
+
+// Limits bounds the work requested by a ThumbnailerMessage. A zero value means no limit.
+type Limits struct {
+	MaxOpts   int
+	MaxWidth  int
+	MaxHeight int
+}
+
+// WithStorage registers fn as the StorageFunc of the given URL scheme.
+func WithStorage(scheme string, fn StorageFunc) Option {
+	return func(t *Thumbnailer) {
+		t.storages[scheme] = fn
+	}
+}
+
+// WithLimits sets the limits enforced on each ThumbnailerMessage.
+func WithLimits(l Limits) Option {
+	return func(t *Thumbnailer) {
+		t.limits = l
+	}
+}
+
+// WithFilter sets the resampling filter used when a ThumbnailOpt does not specify one.
+func WithFilter(filter Filter) Option {
+	return func(t *Thumbnailer) {
+		t.filter = Filter(strings.ToLower(string(filter)))
+	}
+}
+
+// WithNameTemplate sets the template, or the name of a preset, used to name
+// the thumbnails when the ThumbnailerMessage does not specify one.
+func WithNameTemplate(tmpl string) Option {
+	return func(t *Thumbnailer) {
+		t.nameTemplate = tmpl
+	}
+}
+
+// WithPresets sets the presets the messages refer to by name.
+func WithPresets(p Presets) Option {
+	return func(t *Thumbnailer) {
+		t.presets = p
+	}
+}
+
+// WithS3Options sets the default settings of the thumbnails uploaded to S3,
+// a ThumbnailerMessage may override them.
+func WithS3Options(o S3Options) Option {
+	return func(t *Thumbnailer) {
+		t.s3Options = o
+	}
+}
+
+// WithSourceCache keeps the decoded source images in c, it may be shared by
+// several Thumbnailers.
+func WithSourceCache(c *SourceCache) Option {
+	return func(t *Thumbnailer) {
+		t.sourceCache = c
+	}
+}
+
+// WithCallbacks signs the callback requests with secret, an empty secret
+// means no signature. Each attempt is bounded by timeout and the failed
+// requests are retried according to p.
+func WithCallbacks(secret string, timeout time.Duration, p RetryPolicy) Option {
+	return func(t *Thumbnailer) {
+		t.callbacks = newCallbacks(secret, timeout, p)
+	}
+}
+
+// WithFormat registers the format used to encode and decode the files with the extension ext (".jpg").
+func WithFormat(ext string, format imaging.Format) Option {
+	return func(t *Thumbnailer) {
+		t.codec.Formats[ext] = format
+	}
+}
+
+// WithEncodeOptions sets the settings of the encoders.
+func WithEncodeOptions(opts EncodeOptions) Option {
+	return func(t *Thumbnailer) {
+		t.codec.Options = opts
+	}
+}
+
+// WithLogger sets the logger used to report the progress and the errors.
+func WithLogger(logger *log.Logger) Option {
+	return func(t *Thumbnailer) {
+		t.logger = logger
+	}
+}
+
+// WithWorkers caps to n the number of thumbnails generated concurrently by the Thumbnailer.
+// A cloned Thumbnailer keeps the workers it shares when their number is n.
+func WithWorkers(n int) Option {
+	return func(t *Thumbnailer) {
+		if n > 0 {
+			if cap(t.workers) != n {
+				t.workers = make(chan struct{}, n)
+			}
+		} else {
+			t.workers = nil
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package thumbnailer
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+)
+
+// Presets are named ThumbnailOpts, a ThumbnailerMessage refers to them with
+// its Presets field instead of repeating their Opts.
+type Presets map[string]ThumbnailOpt
+
+// presetNameRe matches the names usable in a URL path, the names looking
+// like a size ("50x50") are refused.
+var (
+	presetNameRe = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+	sizeRe       = regexp.MustCompile(`^[0-9]+x[0-9]+$`)
+)
+
+// ReadPresets reads the presets from the JSON file filename, an object
+// mapping the preset names to their ThumbnailOpt:
+//
+//	{"avatar": {"width": 64, "height": 64}, "hero": {"width": 1600, "height": 0}}
+//
+// The presets are validated.
+func ReadPresets(filename string) (Presets, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	p, err := ParsePresets(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	return p, nil
+}
+
+// ParsePresets parses and validates the presets encoded in JSON in data.
+func ParsePresets(data []byte) (Presets, error) {
+	var p Presets
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, fmt.Errorf("An error occured while parsing the presets: %w", err)
+	}
+	if err := p.Validate(); err != nil {
+		return nil, fmt.Errorf("Invalid presets: %w", err)
+	}
+	return p, nil
+}
+
+// Validate checks the names and the options of the presets, their filters
+// are normalized.
+func (p Presets) Validate() error {
+	for name, opt := range p {
+		if !presetNameRe.MatchString(name) || sizeRe.MatchString(name) {
+			return fmt.Errorf("Unsupported preset name: %q", name)
+		}
+		if opt.Width < 0 || opt.Height < 0 {
+			return fmt.Errorf("Negative size in the preset %q", name)
+		}
+		if len(opt.dstImages()) > 0 {
+			return fmt.Errorf("The preset %q can not set the dstImage", name)
+		}
+		if opt.Filter != "" {
+			f, err := ParseFilter(string(opt.Filter))
+			if err != nil {
+				return fmt.Errorf("Invalid preset %q: %w", name, err)
+			}
+			opt.Filter = f
+			p[name] = opt
+		}
+	}
+	return nil
+}
+
+// Opts returns the ThumbnailOpts of the presets names.
+func (p Presets) Opts(names []string) ([]ThumbnailOpt, error) {
+	opts := make([]ThumbnailOpt, 0, len(names))
+	for _, name := range names {
+		opt, ok := p[name]
+		if !ok {
+			return nil, fmt.Errorf("Unknown preset: %q", name)
+		}
+		opts = append(opts, opt)
+	}
+	return opts, nil
+}
@@ -0,0 +1,83 @@
+package thumbnailer
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func Test_ReadPresets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "thumbnailer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	read := func(content string) (Presets, error) {
+		filename := filepath.Join(dir, "presets.json")
+		if err := ioutil.WriteFile(filename, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return ReadPresets(filename)
+	}
+
+	p, err := read(`{"avatar": {"width": 64, "height": 64, "filter": "Box"}, "hero": {"width": 1600, "height": 0}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := Presets{
+		"avatar": {Width: 64, Height: 64, Filter: Box},
+		"hero":   {Width: 1600},
+	}
+	if !reflect.DeepEqual(p, expected) {
+		t.Fatalf("got: %v, expected: %v", p, expected)
+	}
+
+	for _, content := range []string{
+		`{"50x50": {"width": 50, "height": 50}}`,
+		`{"a/b": {"width": 50, "height": 50}}`,
+		`{"avatar": {"width": -1, "height": 50}}`,
+		`{"avatar": {"width": 50, "filter": "unknown"}}`,
+		`{"avatar": {"width": 50, "dstImage": "file:///tmp/avatar.jpg"}}`,
+		`[{"width": 50}]`,
+	} {
+		if _, err := read(content); err == nil {
+			t.Errorf("expected an error for %s", content)
+		}
+	}
+}
+
+func Test_ProcessPresets(t *testing.T) {
+	data, err := ioutil.ReadFile(filepath.Join("testdata", "pic.jpg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := NewMemStorage()
+	m.Put("src/pic.jpg", data)
+	presets := Presets{"avatar": {Width: 50, Height: 50}, "card": {Width: 100}}
+	th := New(WithStorage("mem", m.Storage), WithPresets(presets))
+	tm := ThumbnailerMessage{
+		SrcImage:  "mem://src/pic.jpg",
+		DstFolder: "mem://dst",
+		Opts:      []ThumbnailOpt{{Width: 20, Height: 20}},
+		Presets:   []string{"avatar", "card"},
+	}
+	results, err := th.Process(&tm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 3 {
+		t.Fatalf("expected 3 thumbnails, got %v", results)
+	}
+	for _, key := range []string{"dst/pic_s20x20.jpg", "dst/pic_s50x50.jpg", "dst/pic_s100x75.jpg"} {
+		if _, ok := m.Bytes(key); !ok {
+			t.Errorf("expected the thumbnail %s", key)
+		}
+	}
+
+	tm = ThumbnailerMessage{SrcImage: "mem://src/pic.jpg", DstFolder: "mem://dst", Presets: []string{"hero"}}
+	if _, err := th.Process(&tm); err == nil {
+		t.Fatal("expected an error for the unknown preset")
+	}
+}
@@ -0,0 +1,163 @@
+package thumbnailer
+
+import (
+	"fmt"
+	"image"
+	"math"
+	"sort"
+
+	"github.com/disintegration/imaging"
+)
+
+const (
+	// pyramidOversample is the minimum ratio between an intermediate image
+	// and the thumbnails resized from it. Resampling twice from an image at
+	// least twice as large gives a result close to a direct resize.
+	pyramidOversample = 2.0
+	// pyramidStep is the maximum ratio between an intermediate image and
+	// the oversampled size of the thumbnails resized from it, a smaller
+	// intermediate is built beyond it.
+	pyramidStep = 4.0
+)
+
+// pyramidLevel is a downscaled version of the source image.
+type pyramidLevel struct {
+	img   *image.NRGBA
+	scale float64
+}
+
+// pyramid holds the source image and its downscaled versions, the
+// thumbnails are resized from the smallest level that keeps their quality.
+type pyramid struct {
+	// bounds are the bounds of the source image as stored, the sizes and
+	// the rects of the ThumbnailOpt are relative to them.
+	bounds image.Rectangle
+	// src is the decoded source image, it can be smaller than bounds when
+	// it has been downscaled on decode.
+	src *image.NRGBA
+	// filter is the resampling filter used to build the levels, only the
+	// thumbnails using the same filter are resized from them.
+	filter Filter
+	// levels are ordered from the largest to the smallest.
+	levels []pyramidLevel
+}
+
+// thumbRegion returns the region of the source image used by opt.
+func thumbRegion(src image.Rectangle, opt ThumbnailOpt) image.Rectangle {
+	if opt.Rect != nil {
+		return opt.Rect.newImageRect().Intersect(src)
+	}
+	return src
+}
+
+// thumbSize returns the size of the thumbnail of opt made from a region of
+// regionW x regionH pixels.
+func thumbSize(regionW, regionH int, opt ThumbnailOpt) (int, int) {
+	dstW, dstH := opt.Width, opt.Height
+	if dstW == 0 && dstH == 0 {
+		return regionW, regionH
+	}
+	// if new width or height is 0 then preserve aspect ratio, minimum 1px
+	if dstW == 0 {
+		tmpW := float64(dstH) * float64(regionW) / float64(regionH)
+		dstW = int(math.Max(1.0, math.Floor(tmpW+0.5)))
+	}
+	if dstH == 0 {
+		tmpH := float64(dstW) * float64(regionH) / float64(regionW)
+		dstH = int(math.Max(1.0, math.Floor(tmpH+0.5)))
+	}
+	return dstW, dstH
+}
+
+// thumbScale returns the scale between the thumbnail of opt and the source
+// image, the largest of the horizontal and the vertical ones.
+func thumbScale(src image.Rectangle, opt ThumbnailOpt) float64 {
+	region := thumbRegion(src, opt)
+	if region.Empty() {
+		return 1
+	}
+	w, h := thumbSize(region.Dx(), region.Dy(), opt)
+	return math.Max(float64(w)/float64(region.Dx()), float64(h)/float64(region.Dy()))
+}
+
+// newPyramid builds the levels needed by thumbnails of the given scales,
+// relative to bounds. Each level preserves the aspect ratio of src and is
+// built from the previous one.
+func newPyramid(src *image.NRGBA, bounds image.Rectangle, filter Filter, scales []float64) *pyramid {
+	p := &pyramid{bounds: bounds, src: src, filter: filter}
+	srcScale := math.Min(
+		float64(src.Bounds().Dx())/float64(bounds.Dx()),
+		float64(src.Bounds().Dy())/float64(bounds.Dy()))
+	needed := make([]float64, 0, len(scales))
+	for _, s := range scales {
+		if q := s * pyramidOversample; q < srcScale {
+			needed = append(needed, q)
+		}
+	}
+	sort.Sort(sort.Reverse(sort.Float64Slice(needed)))
+
+	from := src
+	for _, q := range needed {
+		if n := len(p.levels); n > 0 && p.levels[n-1].scale <= q*pyramidStep {
+			continue
+		}
+		w := int(math.Ceil(float64(bounds.Dx()) * q))
+		h := int(math.Ceil(float64(bounds.Dy()) * q))
+		from = imaging.Resize(from, w, h, filter.resampleFilter())
+		p.levels = append(p.levels, pyramidLevel{img: from, scale: q})
+	}
+	return p
+}
+
+// String returns the size of the levels.
+func (p *pyramid) String() string {
+	sizes := make([]string, 0, len(p.levels))
+	for _, l := range p.levels {
+		sizes = append(sizes, fmt.Sprintf("%dx%d", l.img.Bounds().Dx(), l.img.Bounds().Dy()))
+	}
+	return fmt.Sprint(sizes)
+}
+
+// scaleRect maps r from the coordinates of the from rectangle to the ones of to.
+func scaleRect(r, from, to image.Rectangle) image.Rectangle {
+	sx := float64(to.Dx()) / float64(from.Dx())
+	sy := float64(to.Dy()) / float64(from.Dy())
+	return image.Rect(
+		to.Min.X+int(math.Floor(float64(r.Min.X-from.Min.X)*sx+0.5)),
+		to.Min.Y+int(math.Floor(float64(r.Min.Y-from.Min.Y)*sy+0.5)),
+		to.Min.X+int(math.Floor(float64(r.Max.X-from.Min.X)*sx+0.5)),
+		to.Min.Y+int(math.Floor(float64(r.Max.Y-from.Min.Y)*sy+0.5)),
+	).Intersect(to)
+}
+
+// thumbnail returns the thumbnail of opt resized with filter. The size of
+// the thumbnail is always computed from the source image, so it does not
+// depend on the level it is resized from.
+func (p *pyramid) thumbnail(opt ThumbnailOpt, filter Filter) (*image.NRGBA, error) {
+	region := thumbRegion(p.bounds, opt)
+	if region.Empty() {
+		return nil, fmt.Errorf("The rect %v is outside of the image %v", opt.Rect, p.bounds)
+	}
+	w, h := thumbSize(region.Dx(), region.Dy(), opt)
+
+	var img image.Image = p.src
+	if filter == p.filter && (opt.Width != 0 || opt.Height != 0) {
+		q := thumbScale(p.bounds, opt) * pyramidOversample
+		for i := len(p.levels) - 1; i >= 0; i-- {
+			if p.levels[i].scale >= q {
+				img = p.levels[i].img
+				break
+			}
+		}
+	}
+	if img.Bounds() != p.bounds {
+		region = scaleRect(region, p.bounds, img.Bounds())
+	}
+	if region != img.Bounds() {
+		img = imaging.Crop(img, region)
+	}
+	if opt.Width == 0 && opt.Height == 0 && region.Dx() == w && region.Dy() == h {
+		return toNRGBA(img), nil
+	}
+	return imaging.Resize(img, w, h, filter.resampleFilter()), nil
+}
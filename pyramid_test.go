@@ -0,0 +1,80 @@
+package thumbnailer
+
+import (
+	"image"
+	"math"
+	"testing"
+)
+
+// meanDiff returns the mean absolute difference between the channels of a and b.
+func meanDiff(a, b *image.NRGBA) float64 {
+	var sum float64
+	for i := range a.Pix {
+		sum += math.Abs(float64(a.Pix[i]) - float64(b.Pix[i]))
+	}
+	return sum / float64(len(a.Pix))
+}
+
+func Test_pyramidGolden(t *testing.T) {
+	th := New()
+	tm := testThumbnailerMessage()
+	img, err := th.Open(&tm)
+	if err != nil {
+		t.Fatalf("Failed to open tm.SrcImage: %v", err)
+	}
+	src := toNRGBA(img)
+
+	tm.Opts = []ThumbnailOpt{
+		{Width: 600},
+		{Height: 400},
+		{Width: 300, Height: 300},
+		{Width: 40, Height: 0},
+		{Width: 0, Height: 16},
+		{Width: 100, Rect: &rectangle{Min: [2]int{200, 200}, Max: [2]int{600, 600}}},
+		{Width: 30, Height: 10, Rect: &rectangle{Min: [2]int{1000, 0}, Max: [2]int{1700, 300}}},
+	}
+	p := th.newPyramid(tm.Opts, src, src.Bounds())
+	if len(p.levels) < 2 {
+		t.Fatalf("expected several levels for widely differing sizes, got %s", p)
+	}
+	for _, l := range p.levels {
+		b := l.img.Bounds()
+		ratio := float64(b.Dx()) / float64(b.Dy())
+		if math.Abs(ratio-float64(src.Bounds().Dx())/float64(src.Bounds().Dy())) > 0.01 {
+			t.Fatalf("level %dx%d does not preserve the aspect ratio of the source", b.Dx(), b.Dy())
+		}
+	}
+
+	direct := &pyramid{bounds: src.Bounds(), src: src, filter: th.filter}
+	for _, opt := range tm.Opts {
+		golden, err := direct.thumbnail(opt, th.filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		thumb, err := p.thumbnail(opt, th.filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if thumb.Bounds() != golden.Bounds() {
+			t.Fatalf("%+v: got size %v, expected %v", opt, thumb.Bounds(), golden.Bounds())
+		}
+		if d := meanDiff(thumb, golden); d > 1 {
+			t.Fatalf("%+v: mean difference with a direct resize is %.2f", opt, d)
+		}
+	}
+}
+
+func Test_pyramidSkipsOtherFilters(t *testing.T) {
+	src := image.NewNRGBA(image.Rect(0, 0, 800, 600))
+	th := New()
+	tm := ThumbnailerMessage{Opts: []ThumbnailOpt{
+		{Width: 100, Filter: NearestNeighbor},
+		{Width: 50, Filter: NearestNeighbor},
+	}}
+	if p := th.newPyramid(tm.Opts, src, src.Bounds()); len(p.levels) != 0 {
+		t.Fatalf("expected no level, got %s", p)
+	}
+	if _, err := (&pyramid{bounds: src.Bounds(), src: src}).thumbnail(ThumbnailOpt{Width: 10, Rect: &rectangle{Min: [2]int{900, 900}, Max: [2]int{1000, 1000}}}, CatmullRom); err == nil {
+		t.Fatal("expected an error for a rect outside of the image")
+	}
+}
@@ -0,0 +1,271 @@
+package thumbnailer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/disintegration/imaging"
+)
+
+// ErrCircuitOpen is returned without calling the backend while the circuit
+// breaker of its host is open.
+var ErrCircuitOpen = errors.New("Circuit breaker open")
+
+// RetryPolicy configures Retry. A zero MaxAttempts means a single attempt,
+// a zero BreakerThreshold disables the circuit breaker.
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of attempts of an operation.
+	MaxAttempts int
+	// BaseDelay is the delay before the first retry, it doubles after each
+	// attempt up to MaxDelay. A random jitter of up to half the delay is
+	// subtracted from it.
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	// Timeout bounds the time spent on an operation, retries included.
+	Timeout time.Duration
+	// BreakerThreshold is the number of consecutive failures on a host
+	// opening its circuit breaker for BreakerCooldown.
+	BreakerThreshold int
+	BreakerCooldown  time.Duration
+}
+
+// DefaultRetryPolicy retries 3 times within 30s and opens the circuit breaker
+// of a host for 30s after 5 consecutive failures.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:      4,
+	BaseDelay:        100 * time.Millisecond,
+	MaxDelay:         5 * time.Second,
+	Timeout:          30 * time.Second,
+	BreakerThreshold: 5,
+	BreakerCooldown:  30 * time.Second,
+}
+
+// Retry returns a StorageFunc decorating the ImageOpenSaver of fn: the
+// failed operations are retried according to p, until ctx is done, and a
+// circuit breaker is kept per scheme and host (the S3 bucket). The missing
+// images are not retried.
+//
+// The decorated ImageOpenSaver keeps each of the optional interfaces
+// RawOpener, RawSaver, S3Saver, Stater and Deleter it implements. The
+// encoded images given to SaveRaw and SaveS3 are spooled to a temporary file
+// to be sent again.
+func Retry(ctx context.Context, fn StorageFunc, p RetryPolicy) StorageFunc {
+	r := &retrier{ctx: ctx, policy: p, retryable: retryableStorage, breakers: map[string]*breaker{}}
+	return func(u *url.URL, c *Codec) (ImageOpenSaver, error) {
+		s, err := fn(u, c)
+		if err != nil {
+			return nil, err
+		}
+		return withInterfacesOf(retryImageOpenSaver{ImageOpenSaver: s, retrier: r, breaker: r.breaker(u)}, s), nil
+	}
+}
+
+type retrier struct {
+	ctx    context.Context
+	policy RetryPolicy
+	// retryable tells if an operation which failed with err may succeed
+	// later.
+	retryable func(err error) bool
+
+	mu       sync.Mutex
+	breakers map[string]*breaker
+}
+
+func (r *retrier) breaker(u *url.URL) *breaker {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	key := u.Scheme + "://" + u.Host
+	b, ok := r.breakers[key]
+	if !ok {
+		b = &breaker{key: key, threshold: r.policy.BreakerThreshold, cooldown: r.policy.BreakerCooldown}
+		r.breakers[key] = b
+	}
+	return b
+}
+
+// do calls op until it succeeds, fails with a permanent error or the policy
+// gives up.
+func (r *retrier) do(b *breaker, op func() error) error {
+	ctx := r.ctx
+	if r.policy.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.policy.Timeout)
+		defer cancel()
+	}
+	delay := r.policy.BaseDelay
+	for attempt := 1; ; attempt++ {
+		if err := b.allow(); err != nil {
+			return err
+		}
+		err := op()
+		if err == nil || !r.retryable(err) {
+			b.record(nil)
+			return err
+		}
+		b.record(err)
+		if attempt >= r.policy.MaxAttempts {
+			return err
+		}
+		wait := delay
+		if wait > 0 {
+			wait -= time.Duration(rand.Int63n(int64(wait)/2 + 1))
+		}
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < wait {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(wait):
+		}
+		delay *= 2
+		if r.policy.MaxDelay > 0 && delay > r.policy.MaxDelay {
+			delay = r.policy.MaxDelay
+		}
+	}
+}
+
+// retryableStorage tells if a storage operation which failed with err may
+// succeed later, the missing images and the unsupported formats are not
+// retried.
+func retryableStorage(err error) bool {
+	return !errors.Is(err, os.ErrNotExist) && !errors.Is(err, imaging.ErrUnsupportedFormat) && !errors.Is(err, ErrCircuitOpen)
+}
+
+// breaker counts the consecutive failures on a host.
+type breaker struct {
+	key       string
+	threshold int
+	cooldown  time.Duration
+
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+}
+
+func (b *breaker) allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if time.Now().Before(b.openUntil) {
+		return fmt.Errorf("%w for %s", ErrCircuitOpen, b.key)
+	}
+	return nil
+}
+
+func (b *breaker) record(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err == nil {
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.threshold > 0 && b.failures >= b.threshold {
+		b.openUntil = time.Now().Add(b.cooldown)
+		b.failures = 0
+	}
+}
+
+// retryImageOpenSaver retries the operations of an ImageOpenSaver, its
+// optional interfaces are only called when the ImageOpenSaver implements
+// them, see withInterfacesOf.
+type retryImageOpenSaver struct {
+	ImageOpenSaver
+	retrier *retrier
+	breaker *breaker
+}
+
+func (s retryImageOpenSaver) Open() (img image.Image, err error) {
+	err = s.retrier.do(s.breaker, func() error {
+		img, err = s.ImageOpenSaver.Open()
+		return err
+	})
+	return img, err
+}
+
+func (s retryImageOpenSaver) Save(img image.Image) error {
+	return s.retrier.do(s.breaker, func() error {
+		return s.ImageOpenSaver.Save(img)
+	})
+}
+
+func (s retryImageOpenSaver) OpenRaw() (r io.ReadCloser, err error) {
+	err = s.retrier.do(s.breaker, func() error {
+		r, err = s.ImageOpenSaver.(RawOpener).OpenRaw()
+		return err
+	})
+	return r, err
+}
+
+func (s retryImageOpenSaver) SaveRaw(r io.Reader) error {
+	f, size, err := spool(r)
+	if err != nil {
+		return err
+	}
+	defer removeSpool(f)
+	return s.retrier.do(s.breaker, func() error {
+		return s.ImageOpenSaver.(RawSaver).SaveRaw(io.NewSectionReader(f, 0, size))
+	})
+}
+
+func (s retryImageOpenSaver) SaveS3(r io.Reader, o S3Options) error {
+	f, size, err := spool(r)
+	if err != nil {
+		return err
+	}
+	defer removeSpool(f)
+	return s.retrier.do(s.breaker, func() error {
+		return s.ImageOpenSaver.(S3Saver).SaveS3(io.NewSectionReader(f, 0, size), o)
+	})
+}
+
+// spool copies r to a temporary file read again by each attempt, the
+// encoded images are not held in memory.
+func spool(r io.Reader) (*os.File, int64, error) {
+	f, err := ioutil.TempFile("", "thumbnailer-spool-")
+	if err != nil {
+		return nil, 0, err
+	}
+	size, err := io.Copy(f, r)
+	if err != nil {
+		removeSpool(f)
+		return nil, 0, err
+	}
+	return f, size, nil
+}
+
+// removeSpool closes and removes the temporary file f.
+func removeSpool(f *os.File) {
+	f.Close()
+	os.Remove(f.Name())
+}
+
+func (s retryImageOpenSaver) Stat() (info ImageInfo, err error) {
+	err = s.retrier.do(s.breaker, func() error {
+		info, err = s.ImageOpenSaver.(Stater).Stat()
+		return err
+	})
+	return info, err
+}
+
+// Delete succeeds when a retry finds the image already deleted.
+func (s retryImageOpenSaver) Delete() error {
+	attempts := 0
+	return s.retrier.do(s.breaker, func() error {
+		attempts++
+		err := s.ImageOpenSaver.(Deleter).Delete()
+		if attempts > 1 && errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	})
+}
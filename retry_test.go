@@ -0,0 +1,202 @@
+package thumbnailer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gopkg.in/amz.v1/aws"
+)
+
+// flakyImageOpenSaver fails its first failures calls.
+type flakyImageOpenSaver struct {
+	calls    *int
+	failures int
+	err      error
+}
+
+func (s flakyImageOpenSaver) call() error {
+	*s.calls++
+	if *s.calls <= s.failures {
+		return s.err
+	}
+	return nil
+}
+
+func (s flakyImageOpenSaver) Open() (image.Image, error) {
+	return image.NewNRGBA(image.Rect(0, 0, 1, 1)), s.call()
+}
+
+func (s flakyImageOpenSaver) Save(img image.Image) error {
+	return s.call()
+}
+
+func Test_Retry(t *testing.T) {
+	u, _ := url.Parse("flaky://bucket/pic.jpg")
+	policy := RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, BreakerThreshold: 4, BreakerCooldown: time.Hour}
+	newSaver := func(calls *int, failures int, err error) ImageOpenSaver {
+		fn := Retry(context.Background(), func(u *url.URL, c *Codec) (ImageOpenSaver, error) {
+			return flakyImageOpenSaver{calls: calls, failures: failures, err: err}, nil
+		}, policy)
+		s, err := fn(u, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+
+	var calls int
+	if err := newSaver(&calls, 2, errors.New("500")).Save(nil); err != nil || calls != 3 {
+		t.Fatalf("expected a success after 3 calls, got %v after %d calls", err, calls)
+	}
+
+	calls = 0
+	if _, err := newSaver(&calls, 1, os.ErrNotExist).Open(); !os.IsNotExist(err) || calls != 1 {
+		t.Fatalf("expected a missing image not to be retried, got %v after %d calls", err, calls)
+	}
+
+	// The 4th consecutive failure opens the breaker of the bucket
+	calls = 0
+	s := newSaver(&calls, 100, errors.New("500"))
+	s.Save(nil)
+	s.Save(nil)
+	if err := s.Save(nil); !errors.Is(err, ErrCircuitOpen) || calls != 4 {
+		t.Fatalf("expected the breaker to be open, got %v after %d calls", err, calls)
+	}
+
+	// A cancelled context stops the retries
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	calls = 0
+	fn := Retry(ctx, func(u *url.URL, c *Codec) (ImageOpenSaver, error) {
+		return flakyImageOpenSaver{calls: &calls, failures: 100, err: errors.New("500")}, nil
+	}, RetryPolicy{MaxAttempts: 3, BaseDelay: time.Hour})
+	s, _ = fn(u, nil)
+	if err := s.Save(nil); err == nil || calls != 1 {
+		t.Fatalf("expected a single call, got %v after %d calls", err, calls)
+	}
+}
+
+func Test_RetryInterfaces(t *testing.T) {
+	m := NewMemStorage()
+	u, _ := url.Parse("mem://bucket/pic.jpg")
+	s, err := Retry(context.Background(), m.Storage, DefaultRetryPolicy)(u, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, rawOpener := s.(RawOpener)
+	_, rawSaver := s.(RawSaver)
+	_, stater := s.(Stater)
+	_, deleter := s.(Deleter)
+	if !rawOpener || !rawSaver || !stater || !deleter {
+		t.Fatalf("expected %T to keep the optional interfaces", s)
+	}
+	if _, err := s.(Stater).Stat(); !os.IsNotExist(err) {
+		t.Fatalf("expected a not exist error, got %v", err)
+	}
+
+	// The S3 storage can't delete its images
+	u, _ = url.Parse("s3://bucket/pic.jpg")
+	s, err = Retry(context.Background(), S3Storage(aws.Auth{}, aws.USEast, S3Options{}), DefaultRetryPolicy)(u, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, rawOpener = s.(RawOpener)
+	_, rawSaver = s.(RawSaver)
+	_, s3Saver := s.(S3Saver)
+	_, stater = s.(Stater)
+	_, deleter = s.(Deleter)
+	if !rawOpener || !rawSaver || !s3Saver || !stater || deleter {
+		t.Fatalf("expected %T to keep the optional interfaces of the S3 storage", s)
+	}
+
+	var calls int
+	s, err = Retry(context.Background(), func(u *url.URL, c *Codec) (ImageOpenSaver, error) {
+		return flakyImageOpenSaver{calls: &calls}, nil
+	}, DefaultRetryPolicy)(u, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.(RawOpener); ok {
+		t.Fatalf("expected %T not to claim the optional interfaces", s)
+	}
+}
+
+// flakyRawSaver reads the whole image and fails its first failures SaveRaw.
+type flakyRawSaver struct {
+	ImageOpenSaver
+	RawOpener
+	Stater
+	Deleter
+	failures *int
+}
+
+func (s flakyRawSaver) SaveRaw(r io.Reader) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if *s.failures > 0 {
+		*s.failures--
+		return errors.New("500")
+	}
+	return s.ImageOpenSaver.(RawSaver).SaveRaw(bytes.NewReader(data))
+}
+
+func Test_RetrySaveRaw(t *testing.T) {
+	m := NewMemStorage()
+	u, _ := url.Parse("mem://bucket/pic.jpg")
+	failures := 2
+	fn := Retry(context.Background(), func(u *url.URL, c *Codec) (ImageOpenSaver, error) {
+		s, err := m.Storage(u, c)
+		if err != nil {
+			return nil, err
+		}
+		return flakyRawSaver{s, s.(RawOpener), s.(Stater), s.(Deleter), &failures}, nil
+	}, RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond})
+	s, err := fn(u, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := bytes.Repeat([]byte("thumbnail"), 1000)
+	if err := s.(RawSaver).SaveRaw(bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	if saved, ok := m.Bytes("bucket/pic.jpg"); !ok || !bytes.Equal(saved, data) {
+		t.Fatalf("expected the whole image to be saved by the 3rd attempt, got %d bytes", len(saved))
+	}
+}
+
+func Test_RetryS3NotFound(t *testing.T) {
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		http.Error(w, "NoSuchKey", http.StatusNotFound)
+	}))
+	defer srv.Close()
+
+	fn := Retry(context.Background(), S3Storage(aws.Auth{}, aws.Region{S3Endpoint: srv.URL}, S3Options{}), RetryPolicy{MaxAttempts: 3, BreakerThreshold: 1, BreakerCooldown: time.Hour})
+	u, _ := url.Parse("s3://bucket/missing.jpg")
+	s, err := fn(u, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := s.(RawOpener).OpenRaw(); !os.IsNotExist(err) {
+			t.Fatalf("expected a not exist error, got %v", err)
+		}
+	}
+	if n := atomic.LoadInt32(&requests); n != 2 {
+		t.Fatalf("expected the missing image not to be retried nor to open the breaker, got %d requests", n)
+	}
+}
@@ -0,0 +1,142 @@
+package thumbnailer
+
+import (
+	"fmt"
+	"image"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Version is the version of the thumbnailer, it is stored in the metadata of
+// the thumbnails uploaded to S3.
+const Version = "0.2.0"
+
+// S3Options are the settings of the thumbnails uploaded to S3. The empty
+// fields are not sent, except ACL which defaults to "public-read".
+type S3Options struct {
+	// ACL is a canned ACL, e.g. "private" or "public-read".
+	ACL                  string `json:"acl,omitempty"`
+	CacheControl         string `json:"cacheControl,omitempty"`
+	ContentDisposition   string `json:"contentDisposition,omitempty"`
+	StorageClass         string `json:"storageClass,omitempty"`
+	ServerSideEncryption string `json:"serverSideEncryption,omitempty"`
+	// Metadata is stored in the x-amz-meta-* headers.
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// S3Saver is implemented by the ImageOpenSaver uploading their image to S3,
+// r holds the image encoded in the format of their extension.
+type S3Saver interface {
+	SaveS3(r io.Reader, o S3Options) error
+}
+
+var (
+	s3ACLs = map[string]bool{
+		"private": true, "public-read": true, "public-read-write": true,
+		"authenticated-read": true, "aws-exec-read": true,
+		"bucket-owner-read": true, "bucket-owner-full-control": true,
+	}
+	s3StorageClasses = map[string]bool{
+		"STANDARD": true, "REDUCED_REDUNDANCY": true, "STANDARD_IA": true,
+		"ONEZONE_IA": true, "INTELLIGENT_TIERING": true, "GLACIER": true,
+		"GLACIER_IR": true, "DEEP_ARCHIVE": true,
+	}
+	s3Encryptions    = map[string]bool{"AES256": true, "aws:kms": true}
+	s3MetadataNameRe = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+)
+
+// Validate checks the values of o.
+func (o S3Options) Validate() error {
+	if o.ACL != "" && !s3ACLs[o.ACL] {
+		return fmt.Errorf("Unsupported S3 ACL: %q", o.ACL)
+	}
+	if o.StorageClass != "" && !s3StorageClasses[o.StorageClass] {
+		return fmt.Errorf("Unsupported S3 storage class: %q", o.StorageClass)
+	}
+	if o.ServerSideEncryption != "" && !s3Encryptions[o.ServerSideEncryption] {
+		return fmt.Errorf("Unsupported S3 server side encryption: %q", o.ServerSideEncryption)
+	}
+	for k, v := range o.Metadata {
+		if !s3MetadataNameRe.MatchString(k) {
+			return fmt.Errorf("Invalid S3 metadata name: %q", k)
+		}
+		if strings.ContainsAny(v, "\r\n") {
+			return fmt.Errorf("Invalid S3 metadata value for %q", k)
+		}
+	}
+	return nil
+}
+
+// merge returns o overridden by the non empty fields of m, the metadata are
+// merged.
+func (o S3Options) merge(m *S3Options) S3Options {
+	if m == nil {
+		return o
+	}
+	merged := o
+	if m.ACL != "" {
+		merged.ACL = m.ACL
+	}
+	if m.CacheControl != "" {
+		merged.CacheControl = m.CacheControl
+	}
+	if m.ContentDisposition != "" {
+		merged.ContentDisposition = m.ContentDisposition
+	}
+	if m.StorageClass != "" {
+		merged.StorageClass = m.StorageClass
+	}
+	if m.ServerSideEncryption != "" {
+		merged.ServerSideEncryption = m.ServerSideEncryption
+	}
+	merged.Metadata = make(map[string]string, len(o.Metadata)+len(m.Metadata))
+	for k, v := range o.Metadata {
+		merged.Metadata[k] = v
+	}
+	for k, v := range m.Metadata {
+		merged.Metadata[k] = v
+	}
+	return merged
+}
+
+// thumbS3Options returns the S3Options of the thumbnail of tm with the given
+// size, they describe its source, its size and the thumbnailer version.
+func (t *Thumbnailer) thumbS3Options(tm *ThumbnailerMessage, size image.Point) S3Options {
+	o := S3Options{Metadata: map[string]string{
+		"source":    tm.SrcImage,
+		"width":     strconv.Itoa(size.X),
+		"height":    strconv.Itoa(size.Y),
+		"generator": "thumbnailer/" + Version,
+	}}
+	return o.merge(&t.s3Options).merge(tm.S3)
+}
+
+// header returns the headers of an upload of an object of type contType.
+func (o S3Options) header(contType string) http.Header {
+	h := http.Header{}
+	h.Set("Content-Type", contType)
+	acl := o.ACL
+	if acl == "" {
+		acl = "public-read"
+	}
+	h.Set("x-amz-acl", acl)
+	if o.CacheControl != "" {
+		h.Set("Cache-Control", o.CacheControl)
+	}
+	if o.ContentDisposition != "" {
+		h.Set("Content-Disposition", o.ContentDisposition)
+	}
+	if o.StorageClass != "" {
+		h.Set("x-amz-storage-class", o.StorageClass)
+	}
+	if o.ServerSideEncryption != "" {
+		h.Set("x-amz-server-side-encryption", o.ServerSideEncryption)
+	}
+	for k, v := range o.Metadata {
+		h.Set("x-amz-meta-"+strings.ToLower(k), v)
+	}
+	return h
+}
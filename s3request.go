@@ -0,0 +1,100 @@
+package thumbnailer
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/amz.v1/s3"
+)
+
+// request sends a request on the object of s signed with the AWS signature
+// version 2, for the operations amz does not expose. subresource is the
+// query string of the request (e.g. "uploads").
+func (s s3ImageOpenSaver) request(method, subresource string, header http.Header, body io.Reader) (*http.Response, error) {
+	u, err := url.Parse(s.region.S3Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	u.Path = "/" + s.URL.Host + s.URL.Path
+	u.RawQuery = subresource
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+	resource := u.EscapedPath()
+	if subresource != "" {
+		resource += "?" + subresource
+	}
+	req.Header.Set("Authorization", "AWS "+s.auth.AccessKey+":"+s3Signature(s.auth.SecretKey, req, resource))
+	return http.DefaultClient.Do(req)
+}
+
+// initMulti initiates a multipart upload of the object of s with the given
+// headers, amz does not allow to set them.
+func (s s3ImageOpenSaver) initMulti(header http.Header) (*s3.Multi, error) {
+	resp, err := s.request("POST", "uploads", header, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if err := s3ResponseError(resp); err != nil {
+		return nil, err
+	}
+	var result struct {
+		UploadId string
+	}
+	if err := xml.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+	return &s3.Multi{Bucket: s.bucket(), Key: s.URL.Path, UploadId: result.UploadId}, nil
+}
+
+// s3ResponseError returns an error describing resp when its status is not
+// a success. The body of the failed responses is closed.
+func s3ResponseError(resp *http.Response) error {
+	if resp.StatusCode/100 == 2 {
+		return nil
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	return fmt.Errorf("S3 request %s %s failed: %s %s", resp.Request.Method, resp.Request.URL, resp.Status, body)
+}
+
+// s3Signature returns the signature of req for the canonicalized resource.
+func s3Signature(secretKey string, req *http.Request, resource string) string {
+	var amzHeaders []string
+	for k, v := range req.Header {
+		k = strings.ToLower(k)
+		if strings.HasPrefix(k, "x-amz-") {
+			amzHeaders = append(amzHeaders, k+":"+strings.Join(v, ","))
+		}
+	}
+	sort.Strings(amzHeaders)
+
+	toSign := req.Method + "\n" +
+		req.Header.Get("Content-MD5") + "\n" +
+		req.Header.Get("Content-Type") + "\n" +
+		req.Header.Get("Date") + "\n"
+	for _, h := range amzHeaders {
+		toSign += h + "\n"
+	}
+	toSign += resource
+
+	mac := hmac.New(sha1.New, []byte(secretKey))
+	mac.Write([]byte(toSign))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
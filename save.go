@@ -0,0 +1,115 @@
+package thumbnailer
+
+import (
+	"errors"
+	"image"
+	"io"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// saveThumbnail saves img to each of thumbURLs concurrently and returns one
+// result per URL. The destinations accepting encoded bytes share a single
+// encoding of img per extension, which is streamed to all of them.
+func (t *Thumbnailer) saveThumbnail(tm *ThumbnailerMessage, img image.Image, thumbURLs []*url.URL) []ThumbnailResult {
+	results := make([]ThumbnailResult, len(thumbURLs))
+	streams := map[string]*fanoutWriter{}
+	stream := func(ext string) *io.PipeReader {
+		ext = strings.ToLower(ext)
+		if streams[ext] == nil {
+			streams[ext] = &fanoutWriter{}
+		}
+		return streams[ext].pipe()
+	}
+
+	var wg sync.WaitGroup
+	for i, thumbURL := range thumbURLs {
+		thumb, err := t.NewImageOpenSaver(thumbURL)
+		if err != nil {
+			t.logger.Println("An error occured while creating an instance of ImageOpenSaver for", thumbURL, err)
+			results[i] = ThumbnailResult{Thumbnail: thumbURL, Err: err}
+			continue
+		}
+		var save func() error
+		switch saver := thumb.(type) {
+		case S3Saver:
+			r := stream(filepath.Ext(thumbURL.Path))
+			o := t.thumbS3Options(tm, img.Bounds().Size())
+			save = func() error {
+				err := saver.SaveS3(r, o)
+				r.CloseWithError(err)
+				return err
+			}
+		case RawSaver:
+			r := stream(filepath.Ext(thumbURL.Path))
+			save = func() error {
+				err := saver.SaveRaw(r)
+				r.CloseWithError(err)
+				return err
+			}
+		default:
+			save = func() error { return thumb.Save(img) }
+		}
+
+		wg.Add(1)
+		go func(i int, thumbURL *url.URL, save func() error) {
+			defer wg.Done()
+			timerStart := time.Now()
+			if err := save(); err != nil {
+				t.logger.Println("An error occured while saving,", thumbURL, err)
+				results[i] = ThumbnailResult{Thumbnail: thumbURL, Err: err}
+				return
+			}
+			t.logger.Println("thumb :", thumbURL, " saved in : ", time.Since(timerStart))
+			results[i] = ThumbnailResult{Thumbnail: thumbURL}
+		}(i, thumbURL, save)
+	}
+	for ext, w := range streams {
+		go w.encode(&t.codec, img, ext)
+	}
+	wg.Wait()
+	return results
+}
+
+// fanoutWriter writes to several pipes. A pipe closed by its reader is
+// dropped, so a failed destination does not stop the others.
+type fanoutWriter struct {
+	writers []*io.PipeWriter
+	dropped []bool
+}
+
+func (f *fanoutWriter) pipe() *io.PipeReader {
+	pr, pw := io.Pipe()
+	f.writers = append(f.writers, pw)
+	f.dropped = append(f.dropped, false)
+	return pr
+}
+
+func (f *fanoutWriter) Write(p []byte) (int, error) {
+	written := false
+	for i, w := range f.writers {
+		if f.dropped[i] {
+			continue
+		}
+		if _, err := w.Write(p); err != nil {
+			f.dropped[i] = true
+			continue
+		}
+		written = true
+	}
+	if !written {
+		return 0, errors.New("All the destinations failed")
+	}
+	return len(p), nil
+}
+
+// encode encodes img to all the pipes of f and closes them.
+func (f *fanoutWriter) encode(c *Codec, img image.Image, ext string) {
+	err := c.Encode(f, img, ext)
+	for _, w := range f.writers {
+		w.CloseWithError(err)
+	}
+}
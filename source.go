@@ -0,0 +1,169 @@
+package thumbnailer
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"image"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"path/filepath"
+)
+
+// source is an opened source image. Its bounds are known before it is
+// decoded, so the thumbnails can be named and the decoding sized for them.
+type source struct {
+	url    *url.URL
+	opener ImageOpenSaver
+	bounds image.Rectangle
+	// img is set when the image had to be decoded to know its bounds.
+	img image.Image
+	// reader and header are set when the image is still to be decoded,
+	// header holds the bytes already read from reader.
+	reader io.ReadCloser
+	header bytes.Buffer
+	// body reads from reader and feeds hash with the bytes of the image.
+	body io.Reader
+	hash hash.Hash
+	// eof is set once body has been read entirely, hash is then complete.
+	eof bool
+	// cache holds the decoded images of the sources, under their key.
+	cache *SourceCache
+	key   string
+	// cachedSum is the hash of the source decoded from the cache.
+	cachedSum string
+}
+
+// openSource opens tm.SrcImage and reads its bounds. When the backend gives
+// access to the encoded bytes only the header of the image is read.
+func (t *Thumbnailer) openSource(tm *ThumbnailerMessage) (*source, error) {
+	sURL, err := url.Parse(tm.SrcImage)
+	if err != nil {
+		return nil, err
+	}
+	opener, err := t.NewImageOpenSaver(sURL)
+	if err != nil {
+		return nil, err
+	}
+	s := &source{url: sURL, opener: opener}
+	if stater, ok := opener.(Stater); ok && t.sourceCache != nil {
+		if info, err := stater.Stat(); err == nil {
+			s.cache, s.key = t.sourceCache, cacheKey(sURL, info)
+		}
+	}
+	raw, ok := opener.(RawOpener)
+	if !ok {
+		return s, s.decodeAll(opener.Open())
+	}
+
+	reader, err := raw.OpenRaw()
+	if err != nil {
+		return nil, err
+	}
+	s.reader = reader
+	s.hash = sha256.New()
+	s.body = io.TeeReader(reader, s.hash)
+	// The bytes read by DecodeConfig are replayed to the decoder
+	config, _, err := image.DecodeConfig(io.TeeReader(s.body, &s.header))
+	if err != nil {
+		t.logger.Println("Failed to read the size of", tm.SrcImage, err)
+		defer s.Close()
+		img, err := t.codec.Decode(io.MultiReader(&s.header, s.body), filepath.Ext(sURL.Path))
+		if err == nil {
+			err = s.drain()
+		}
+		return s, s.decodeAll(img, err)
+	}
+	s.bounds = image.Rect(0, 0, config.Width, config.Height)
+	return s, nil
+}
+
+func (s *source) decodeAll(img image.Image, err error) error {
+	if err != nil {
+		return err
+	}
+	s.img = img
+	s.bounds = img.Bounds()
+	return nil
+}
+
+// drain reads the rest of the source image, so its hash is complete.
+func (s *source) drain() error {
+	if s.eof || s.body == nil {
+		return nil
+	}
+	if _, err := io.Copy(ioutil.Discard, s.body); err != nil {
+		return err
+	}
+	s.eof = true
+	return nil
+}
+
+// readAll reads the whole source image in memory, so its hash is known
+// before it is decoded.
+func (s *source) readAll() error {
+	if s.eof || s.body == nil {
+		return nil
+	}
+	if _, err := io.Copy(&s.header, s.body); err != nil {
+		return err
+	}
+	s.eof = true
+	return nil
+}
+
+// sum returns the hex encoded SHA-256 of the source image, or an empty
+// string when the image has not been read entirely.
+func (s *source) sum() string {
+	if !s.eof {
+		return s.cachedSum
+	}
+	return hex.EncodeToString(s.hash.Sum(nil))
+}
+
+// decode decodes the source image with c, it may be downscaled on decode
+// while staying at least as large as hint. The image is shared with the
+// other sources when it comes from the cache.
+func (s *source) decode(c *Codec, hint image.Point) (image.Image, error) {
+	if s.img != nil {
+		return s.img, nil
+	}
+	defer s.Close()
+	if s.cache == nil {
+		return s.decodeReader(c, hint)
+	}
+	e, err := s.cache.get(s.key, hint, func() (*sourceEntry, error) {
+		img, err := s.decodeReader(c, s.cache.hint(hint))
+		if err != nil {
+			return nil, err
+		}
+		return &sourceEntry{img: toNRGBA(img), bounds: s.bounds, hash: s.sum()}, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !s.eof {
+		s.cachedSum = e.hash
+	}
+	return e.img, nil
+}
+
+func (s *source) decodeReader(c *Codec, hint image.Point) (image.Image, error) {
+	img, err := c.DecodeHint(io.MultiReader(&s.header, s.body), filepath.Ext(s.url.Path), hint)
+	if err != nil {
+		return nil, err
+	}
+	return img, s.drain()
+}
+
+// Close releases the reader of the source image.
+func (s *source) Close() error {
+	if s.reader == nil {
+		return nil
+	}
+	err := s.reader.Close()
+	s.reader = nil
+	return err
+}
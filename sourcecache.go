@@ -0,0 +1,148 @@
+package thumbnailer
+
+import (
+	"container/list"
+	"image"
+	"sync"
+)
+
+// SourceCache keeps the decoded source images in memory, so the requests
+// of several sizes of the same source share one decode. The concurrent
+// decodes of a source are deduplicated, the least recently used images are
+// evicted once the cache exceeds its byte budget.
+//
+// A SourceCache is used by a Thumbnailer created with WithSourceCache, the
+// sources are only cached when their backend implements Stater.
+type SourceCache struct {
+	maxBytes   int64
+	decodeSize image.Point
+
+	mu      sync.Mutex
+	size    int64
+	lru     *list.List
+	entries map[string]*list.Element
+	flights map[string]*sourceFlight
+}
+
+// sourceEntry is a decoded source image.
+type sourceEntry struct {
+	key string
+	img *image.NRGBA
+	// bounds are the bounds of the source, img may be smaller.
+	bounds image.Rectangle
+	// hash is the hash of the source bytes, when it is known.
+	hash string
+}
+
+type sourceFlight struct {
+	done  chan struct{}
+	entry *sourceEntry
+	err   error
+}
+
+// NewSourceCache returns a SourceCache holding at most maxBytes of pixels.
+// The sources are decoded at least as large as decodeSize, or as large as
+// needed by the thumbnail when it is larger, a zero decodeSize caches the
+// sources at their full size.
+func NewSourceCache(maxBytes int64, decodeSize image.Point) *SourceCache {
+	return &SourceCache{
+		maxBytes:   maxBytes,
+		decodeSize: decodeSize,
+		lru:        list.New(),
+		entries:    map[string]*list.Element{},
+		flights:    map[string]*sourceFlight{},
+	}
+}
+
+// Size returns the number of bytes held by the cache.
+func (c *SourceCache) Size() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.size
+}
+
+// hint returns the size hint used to decode a source needed at hint.
+func (c *SourceCache) hint(hint image.Point) image.Point {
+	if c.decodeSize == (image.Point{}) {
+		return image.Point{}
+	}
+	if hint.X < c.decodeSize.X {
+		hint.X = c.decodeSize.X
+	}
+	if hint.Y < c.decodeSize.Y {
+		hint.Y = c.decodeSize.Y
+	}
+	return hint
+}
+
+// fits tells if e can be used to make thumbnails needing a source decoded
+// at hint.
+func (e *sourceEntry) fits(hint image.Point) bool {
+	size := e.img.Bounds().Size()
+	return size == e.bounds.Size() || (size.X >= hint.X && size.Y >= hint.Y)
+}
+
+// get returns the image of key fitting hint, decoded by decode unless it is
+// cached. The callers waiting for the decode of an image too small for them
+// decode it again.
+func (c *SourceCache) get(key string, hint image.Point, decode func() (*sourceEntry, error)) (*sourceEntry, error) {
+	c.mu.Lock()
+	for {
+		if elem, ok := c.entries[key]; ok && elem.Value.(*sourceEntry).fits(hint) {
+			c.lru.MoveToFront(elem)
+			c.mu.Unlock()
+			return elem.Value.(*sourceEntry), nil
+		}
+		f, ok := c.flights[key]
+		if !ok {
+			break
+		}
+		c.mu.Unlock()
+		<-f.done
+		if f.err == nil && f.entry.fits(hint) {
+			return f.entry, nil
+		}
+		// The image is too small, or its decode failed
+		c.mu.Lock()
+	}
+	f := &sourceFlight{done: make(chan struct{})}
+	c.flights[key] = f
+	c.mu.Unlock()
+
+	f.entry, f.err = decode()
+	if f.err == nil {
+		f.entry.key = key
+	}
+
+	c.mu.Lock()
+	delete(c.flights, key)
+	if f.err == nil {
+		c.add(f.entry)
+	}
+	c.mu.Unlock()
+	close(f.done)
+	return f.entry, f.err
+}
+
+// add stores e, it replaces the image with the same key.
+func (c *SourceCache) add(e *sourceEntry) {
+	if elem, ok := c.entries[e.key]; ok {
+		c.remove(elem)
+	}
+	size := int64(len(e.img.Pix))
+	if size > c.maxBytes {
+		return
+	}
+	c.entries[e.key] = c.lru.PushFront(e)
+	c.size += size
+	for c.size > c.maxBytes {
+		c.remove(c.lru.Back())
+	}
+}
+
+func (c *SourceCache) remove(elem *list.Element) {
+	e := elem.Value.(*sourceEntry)
+	c.lru.Remove(elem)
+	delete(c.entries, e.key)
+	c.size -= int64(len(e.img.Pix))
+}
@@ -0,0 +1,115 @@
+package thumbnailer
+
+import (
+	"image"
+	"io/ioutil"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func Test_SourceCacheSingleFlight(t *testing.T) {
+	c := NewSourceCache(700000, image.Pt(100, 100))
+	var mu sync.Mutex
+	decodes := 0
+	decode := func(size int) func() (*sourceEntry, error) {
+		return func() (*sourceEntry, error) {
+			mu.Lock()
+			decodes++
+			mu.Unlock()
+			time.Sleep(10 * time.Millisecond)
+			return &sourceEntry{img: image.NewNRGBA(image.Rect(0, 0, size, size)), bounds: image.Rect(0, 0, 400, 400)}, nil
+		}
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := c.get("src", image.Pt(50, 50), decode(100)); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if decodes != 1 {
+		t.Fatalf("expected a single decode, got %d", decodes)
+	}
+
+	// A larger size needs another decode, which replaces the cached image
+	e, err := c.get("src", image.Pt(200, 200), decode(200))
+	if err != nil || decodes != 2 || e.img.Bounds().Dx() != 200 {
+		t.Fatalf("expected a new decode at 200x200, got %v %v after %d decodes", e, err, decodes)
+	}
+	if size := c.Size(); size != 200*200*4 {
+		t.Fatalf("got: %d cached bytes, expected: %d", size, 200*200*4)
+	}
+
+	// The least recently used images are evicted to fit in the budget
+	c.get("other", image.Pt(50, 50), decode(400))
+	if size := c.Size(); size != 400*400*4 {
+		t.Fatalf("got: %d cached bytes, expected: %d", size, 400*400*4)
+	}
+}
+
+func Test_GenerateThumbnailsSourceCache(t *testing.T) {
+	data, err := ioutil.ReadFile(filepath.Join("testdata", "pic.jpg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := NewMemStorage()
+	m.Put("src/pic.jpg", data)
+	cache := NewSourceCache(64<<20, image.Point{})
+	th := New(WithStorage("mem", m.Storage), WithSourceCache(cache))
+	for _, width := range []int{100, 200, 50} {
+		tm := ThumbnailerMessage{
+			SrcImage:  "mem://src/pic.jpg",
+			DstFolder: "mem://dst",
+			Opts:      []ThumbnailOpt{{Width: width}},
+		}
+		results, err := th.Process(&tm)
+		if err != nil {
+			t.Fatal("An error occured while generating the thumbs :", err)
+		}
+		if results[0].SourceHash == "" {
+			t.Fatal("expected the SourceHash of the cached source")
+		}
+	}
+	// The source is cached at its full size
+	if size := cache.Size(); size != 1632*1224*4 {
+		t.Fatalf("got: %d cached bytes, expected: %d", size, 1632*1224*4)
+	}
+	if size, err := m.Size("dst/pic_s200x150.jpg"); err != nil || size != image.Pt(200, 150) {
+		t.Fatalf("got: %v %v, expected: 200x150", size, err)
+	}
+}
+
+func Test_GenerateThumbnailsSourceCacheS3(t *testing.T) {
+	data, err := ioutil.ReadFile(filepath.Join("testdata", "pic.jpg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s3 := newFakeS3()
+	s3.put("/bucket/src/pic.jpg", data, time.Now())
+	srv := httptest.NewServer(s3)
+	defer srv.Close()
+
+	cache := NewSourceCache(64<<20, image.Point{})
+	th := New(WithStorage("s3", s3Stack(t, srv)), WithSourceCache(cache))
+	for _, width := range []int{100, 200} {
+		tm := ThumbnailerMessage{
+			SrcImage:  "s3://bucket/src/pic.jpg",
+			DstFolder: "s3://bucket/thumbs",
+			Opts:      []ThumbnailOpt{{Width: width}},
+		}
+		if _, err := th.Process(&tm); err != nil {
+			t.Fatal("An error occured while generating the thumbs :", err)
+		}
+	}
+	if size := cache.Size(); size != 1632*1224*4 {
+		t.Fatalf("got: %d cached bytes, expected: %d", size, 1632*1224*4)
+	}
+}
@@ -0,0 +1,407 @@
+package thumbnailer
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/amz.v1/aws"
+	"gopkg.in/amz.v1/s3"
+)
+
+type imageOpenSaverError struct {
+	url *url.URL
+}
+
+func (e imageOpenSaverError) Error() string {
+	return fmt.Sprintf("imageOpenSaverError with URL:%v", e.url)
+}
+
+// ImageOpenSaver interface that can Open and Close images from a given backend:fs,  s3, ...
+type ImageOpenSaver interface {
+	Open() (image.Image, error)
+	Save(img image.Image) error
+}
+
+// RawOpener is implemented by the ImageOpenSaver giving access to the
+// encoded bytes of their image.
+type RawOpener interface {
+	OpenRaw() (io.ReadCloser, error)
+}
+
+// RawSaver is implemented by the ImageOpenSaver able to save an image read
+// from r, already encoded in the format of their extension.
+type RawSaver interface {
+	SaveRaw(r io.Reader) error
+}
+
+// ImageInfo describes a stored image.
+type ImageInfo struct {
+	Size    int64
+	ModTime time.Time
+	// ETag identifies the content of the image, when the backend knows it.
+	ETag string
+}
+
+// Stater is implemented by the ImageOpenSaver able to describe their image
+// without reading it. The error returned when the image does not exist
+// satisfies os.IsNotExist.
+type Stater interface {
+	Stat() (ImageInfo, error)
+}
+
+// Deleter is implemented by the ImageOpenSaver able to delete their image.
+type Deleter interface {
+	Delete() error
+}
+
+// StorageFunc returns the ImageOpenSaver for u. The images are decoded and
+// encoded with c.
+type StorageFunc func(u *url.URL, c *Codec) (ImageOpenSaver, error)
+
+// Default permissions of the files and directories created by FileStorage.
+const (
+	DefaultFileMode os.FileMode = 0644
+	DefaultDirMode  os.FileMode = 0755
+)
+
+// FileStorage is the StorageFunc of the file:// scheme, the files and
+// directories are created with DefaultFileMode and DefaultDirMode.
+func FileStorage(u *url.URL, c *Codec) (ImageOpenSaver, error) {
+	return FileStorageMode(DefaultFileMode, DefaultDirMode)(u, c)
+}
+
+// FileStorageMode returns the StorageFunc of the file:// scheme creating the
+// files with fileMode and the missing directories with dirMode.
+func FileStorageMode(fileMode, dirMode os.FileMode) StorageFunc {
+	return func(u *url.URL, c *Codec) (ImageOpenSaver, error) {
+		return &fsImageOpenSaver{URL: u, codec: c, fileMode: fileMode, dirMode: dirMode}, nil
+	}
+}
+
+// S3Storage returns the StorageFunc of the s3:// scheme, requests are
+// authenticated with auth and sent to region. The images are uploaded with
+// the settings o, overridden by the ones given to SaveS3.
+func S3Storage(auth aws.Auth, region aws.Region, o S3Options) StorageFunc {
+	return func(u *url.URL, c *Codec) (ImageOpenSaver, error) {
+		return &s3ImageOpenSaver{URL: u, codec: c, auth: auth, region: region, options: o}, nil
+	}
+}
+
+// sigV4Regions are the S3 regions only accepting the AWS signature version
+// 4, the requests of amz and of s3ImageOpenSaver.request are signed with the
+// version 2.
+var sigV4Regions = map[string]bool{
+	"eu-central-1":   true,
+	"eu-west-2":      true,
+	"eu-west-3":      true,
+	"eu-north-1":     true,
+	"us-east-2":      true,
+	"ca-central-1":   true,
+	"ap-south-1":     true,
+	"ap-northeast-2": true,
+	"ap-northeast-3": true,
+	"cn-north-1":     true,
+	"cn-northwest-1": true,
+}
+
+// NewS3Storage returns the StorageFunc of the s3:// scheme authenticated with
+// the given keys, or with the AWS environment variables when they are empty,
+// and sent to the region named region ("us-east-1"), uploading the images
+// with the settings o. The regions requiring the AWS signature version 4 are
+// not supported.
+func NewS3Storage(accessKey, secretKey, region string, o S3Options) (StorageFunc, error) {
+	if err := o.Validate(); err != nil {
+		return nil, err
+	}
+	if sigV4Regions[region] {
+		return nil, fmt.Errorf("The S3 region %q requires the AWS signature version 4, which is not supported", region)
+	}
+	r, ok := aws.Regions[region]
+	if !ok {
+		return nil, fmt.Errorf("Unknown S3 region: %q", region)
+	}
+	auth := aws.Auth{AccessKey: accessKey, SecretKey: secretKey}
+	if accessKey == "" && secretKey == "" {
+		var err error
+		if auth, err = aws.EnvAuth(); err != nil {
+			return nil, err
+		}
+	}
+	return S3Storage(auth, r, o), nil
+}
+
+// EnvS3Storage is the default StorageFunc of the s3:// scheme, it reads the
+// credentials from the AWS environment variables and uploads the images with
+// the default S3Options.
+func EnvS3Storage(u *url.URL, c *Codec) (ImageOpenSaver, error) {
+	auth, err := aws.EnvAuth()
+	if err != nil {
+		return nil, err
+	}
+	return S3Storage(auth, aws.USEast, S3Options{})(u, c)
+}
+
+// ParseFileMode parses the octal permissions s, e.g. "0644".
+func ParseFileMode(s string) (os.FileMode, error) {
+	mode, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || os.FileMode(mode)&^os.ModePerm != 0 {
+		return 0, fmt.Errorf("Invalid file permissions: %q", s)
+	}
+	return os.FileMode(mode), nil
+}
+
+// filesystem implementation of the ImageOpenSaver interface
+type fsImageOpenSaver struct {
+	URL      *url.URL
+	codec    *Codec
+	fileMode os.FileMode
+	dirMode  os.FileMode
+}
+
+func (s fsImageOpenSaver) OpenRaw() (io.ReadCloser, error) {
+	return os.Open(s.URL.Path)
+}
+
+func (s fsImageOpenSaver) Open() (image.Image, error) {
+	file, err := s.OpenRaw()
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return s.codec.Decode(file, filepath.Ext(s.URL.Path))
+}
+
+// Save saves the image to file with the specified filename.
+// The format is determined from the filename extension: "jpg" (or "jpeg"), "png", "gif", "tif" (or "tiff") and "bmp" are supported.
+// The image is written to a temporary file renamed once synced, so the file
+// is either missing or complete. The missing parent directories are created.
+func (s fsImageOpenSaver) Save(img image.Image) error {
+	ext := filepath.Ext(s.URL.Path)
+	if _, err := s.codec.Format(ext); err != nil {
+		return err
+	}
+
+	return s.saveFile(func(w io.Writer) error {
+		return s.codec.Encode(w, img, ext)
+	})
+}
+
+// SaveRaw saves the encoded image read from r like Save.
+func (s fsImageOpenSaver) SaveRaw(r io.Reader) error {
+	return s.saveFile(func(w io.Writer) error {
+		_, err := io.Copy(w, r)
+		return err
+	})
+}
+
+// saveFile writes the file with write to a temporary file renamed once
+// synced. The missing parent directories are created.
+func (s fsImageOpenSaver) saveFile(write func(w io.Writer) error) error {
+	dir, name := filepath.Split(s.URL.Path)
+	if err := os.MkdirAll(dir, s.dirMode); err != nil {
+		return err
+	}
+	// The temporary file is in the same directory to be renamed atomically
+	file, err := ioutil.TempFile(dir, "."+name+".tmp")
+	if err != nil {
+		return err
+	}
+	if err := s.writeFile(file, write); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return err
+	}
+	if err := os.Rename(file.Name(), s.URL.Path); err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+	return nil
+}
+
+// writeFile writes file with write, syncs and closes it.
+func (s fsImageOpenSaver) writeFile(file *os.File, write func(w io.Writer) error) error {
+	if err := write(file); err != nil {
+		return err
+	}
+	if err := file.Chmod(s.fileMode); err != nil {
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+func (s fsImageOpenSaver) Stat() (ImageInfo, error) {
+	fi, err := os.Stat(s.URL.Path)
+	if err != nil {
+		return ImageInfo{}, err
+	}
+	return ImageInfo{Size: fi.Size(), ModTime: fi.ModTime()}, nil
+}
+
+func (s fsImageOpenSaver) Delete() error {
+	err := os.Remove(s.URL.Path)
+	if err != nil {
+		return fmt.Errorf("Failed to remove %s,%w", s.URL.Path, err)
+	}
+	return nil
+}
+
+// s3 implementation of the s3ImageOpenSaver interface
+type s3ImageOpenSaver struct {
+	URL    *url.URL
+	codec  *Codec
+	auth   aws.Auth
+	region aws.Region
+	// options are the settings of the uploads, overridden by the ones
+	// given to SaveS3.
+	options S3Options
+}
+
+func (s s3ImageOpenSaver) bucket() *s3.Bucket {
+	return s3.New(s.auth, s.region).Bucket(s.URL.Host)
+}
+
+// OpenRaw returns the body of the object, a missing object is reported with
+// an error satisfying os.IsNotExist so it is not retried.
+func (s s3ImageOpenSaver) OpenRaw() (io.ReadCloser, error) {
+	resp, err := s.request("GET", "", nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, &os.PathError{Op: "open", Path: s.URL.String(), Err: os.ErrNotExist}
+	}
+	if err := s3ResponseError(resp); err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (s s3ImageOpenSaver) Open() (image.Image, error) {
+	reader, err := s.OpenRaw()
+	if err != nil {
+		return nil, err
+	}
+
+	defer reader.Close()
+	return s.codec.Decode(reader, filepath.Ext(s.URL.Path))
+}
+
+func (s s3ImageOpenSaver) Stat() (ImageInfo, error) {
+	resp, err := s.request("HEAD", "", nil, nil)
+	if err != nil {
+		return ImageInfo{}, err
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return ImageInfo{}, &os.PathError{Op: "stat", Path: s.URL.String(), Err: os.ErrNotExist}
+	default:
+		return ImageInfo{}, fmt.Errorf("Failed to stat %s: %s", s.URL, resp.Status)
+	}
+	modTime, err := http.ParseTime(resp.Header.Get("Last-Modified"))
+	if err != nil {
+		return ImageInfo{}, err
+	}
+	return ImageInfo{Size: resp.ContentLength, ModTime: modTime, ETag: resp.Header.Get("ETag")}, nil
+}
+
+// s3PartSize is the size of the parts of the multipart uploads, the images
+// encoded in less bytes are uploaded with a single request.
+const s3PartSize = 5 << 20
+
+// Save encodes img with the codec while uploading it with the S3Options of
+// the storage, so at most one part of the encoded image is held in memory.
+func (s s3ImageOpenSaver) Save(img image.Image) error {
+	ext := filepath.Ext(s.URL.Path)
+	if _, err := s.codec.Format(ext); err != nil {
+		return err
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(s.codec.Encode(pw, img, ext))
+	}()
+	err := s.SaveRaw(pr)
+	// Unblocks the encoder when the upload failed
+	pr.CloseWithError(err)
+	return err
+}
+
+// SaveRaw uploads the encoded image read from r with the S3Options of the
+// storage.
+func (s s3ImageOpenSaver) SaveRaw(r io.Reader) error {
+	return s.SaveS3(r, S3Options{})
+}
+
+// SaveS3 uploads the encoded image read from r with the S3Options of the
+// storage overridden by o.
+func (s s3ImageOpenSaver) SaveS3(r io.Reader, o S3Options) error {
+	o = s.options.merge(&o)
+	if err := o.Validate(); err != nil {
+		return err
+	}
+	contType := mime.TypeByExtension(strings.ToLower(filepath.Ext(s.URL.Path)))
+	if err := s.upload(r, o.header(contType)); err != nil {
+		log.Println("An error occured while putting on S3", s.URL, err)
+		return err
+	}
+	return nil
+}
+
+// upload uploads the content of r with the given headers, with a multipart
+// upload when it is larger than s3PartSize.
+func (s s3ImageOpenSaver) upload(r io.Reader, header http.Header) error {
+	buf := make([]byte, s3PartSize)
+	n, err := io.ReadFull(r, buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		resp, err := s.request("PUT", "", header, bytes.NewReader(buf[:n]))
+		if err != nil {
+			return err
+		}
+		return s3ResponseError(resp)
+	}
+	if err != nil {
+		return err
+	}
+
+	multi, err := s.initMulti(header)
+	if err != nil {
+		return err
+	}
+	var parts []s3.Part
+	for n > 0 {
+		part, err := multi.PutPart(len(parts)+1, bytes.NewReader(buf[:n]))
+		if err != nil {
+			multi.Abort()
+			return err
+		}
+		parts = append(parts, part)
+		n, err = io.ReadFull(r, buf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			multi.Abort()
+			return err
+		}
+	}
+	if err := multi.Complete(parts); err != nil {
+		multi.Abort()
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,247 @@
+package thumbnailer
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"image"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"gopkg.in/amz.v1/aws"
+)
+
+func Test_fsSave(t *testing.T) {
+	dir, err := ioutil.TempDir("", "thumbnailer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := Codec{Formats: defaultFormats(), Options: defaultEncodeOptions}
+	img := image.NewNRGBA(image.Rect(0, 0, 10, 10))
+	save := func(name string) error {
+		u := &url.URL{Scheme: "file", Path: filepath.Join(dir, name)}
+		s, err := FileStorageMode(0600, 0700)(u, &c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s.Save(img)
+	}
+
+	// The missing parent directories are created
+	if err := save("a/b/thumb.jpg"); err != nil {
+		t.Fatal("An error occured while saving the thumb :", err)
+	}
+	fi, err := os.Stat(filepath.Join(dir, "a", "b", "thumb.jpg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Fatalf("got: %v, expected: %v", fi.Mode().Perm(), os.FileMode(0600))
+	}
+	fi, err = os.Stat(filepath.Join(dir, "a", "b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0700 {
+		t.Fatalf("got: %v, expected: %v", fi.Mode().Perm(), os.FileMode(0700))
+	}
+
+	// A failed save leaves neither the file nor the temporary file
+	if err := os.Mkdir(filepath.Join(dir, "a", "b", "dir.jpg"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := save("a/b/dir.jpg"); err == nil {
+		t.Fatal("expected an error when renaming over a directory")
+	}
+	files, err := ioutil.ReadDir(filepath.Join(dir, "a", "b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 {
+		t.Fatalf("expected the temporary files to be removed, got %d files", len(files))
+	}
+}
+
+func Test_ParseFileMode(t *testing.T) {
+	if mode, err := ParseFileMode("0640"); err != nil || mode != 0640 {
+		t.Fatalf("got: %v %v, expected: %v", mode, err, os.FileMode(0640))
+	}
+	for _, s := range []string{"", "rw", "0999", "17777"} {
+		if _, err := ParseFileMode(s); err == nil {
+			t.Fatalf("expected an error for %q", s)
+		}
+	}
+}
+
+func Test_NewS3StorageRegions(t *testing.T) {
+	for _, region := range []string{"eu-central-1", "unknown"} {
+		if _, err := NewS3Storage("key", "secret", region, S3Options{}); err == nil {
+			t.Errorf("expected an error for the region %s", region)
+		}
+	}
+	if _, err := NewS3Storage("key", "secret", "us-east-1", S3Options{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_s3SaveOptions(t *testing.T) {
+	var puts []*http.Request
+	var mu sync.Mutex
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		puts = append(puts, r)
+	}))
+	defer srv.Close()
+
+	th := New(
+		WithStorage("s3", S3Storage(aws.Auth{AccessKey: "key", SecretKey: "secret"}, aws.Region{S3Endpoint: srv.URL}, S3Options{})),
+		WithS3Options(S3Options{ACL: "private", CacheControl: "max-age=60"}),
+	)
+	tm := testThumbnailerMessage()
+	tm.DstFolder = "s3://bucket/thumbs"
+	tm.S3 = &S3Options{CacheControl: "max-age=3600", Metadata: map[string]string{"Owner": "42"}}
+	if _, err := th.Process(&tm); err != nil {
+		t.Fatal("An error occured while generating the thumbs :", err)
+	}
+	if len(puts) != 1 {
+		t.Fatalf("expected a single PUT, got %d requests", len(puts))
+	}
+	r := puts[0]
+	if r.Method != "PUT" || r.URL.Path != "/bucket/thumbs/pic_s100x100.jpg" {
+		t.Fatalf("unexpected request %s %s", r.Method, r.URL.Path)
+	}
+	for k, v := range map[string]string{
+		"Content-Type":         "image/jpeg",
+		"X-Amz-Acl":            "private",
+		"Cache-Control":        "max-age=3600",
+		"X-Amz-Meta-Owner":     "42",
+		"X-Amz-Meta-Width":     "100",
+		"X-Amz-Meta-Source":    tm.SrcImage,
+		"X-Amz-Meta-Generator": "thumbnailer/" + Version,
+	} {
+		if got := r.Header.Get(k); got != v {
+			t.Fatalf("%s got: %q, expected: %q", k, got, v)
+		}
+	}
+
+	tm.S3 = &S3Options{ACL: "everyone"}
+	if _, err := th.Process(&tm); err == nil {
+		t.Fatal("expected an error for an unsupported ACL")
+	}
+}
+
+func Test_s3StorageOptions(t *testing.T) {
+	var acls []string
+	var mu sync.Mutex
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		acls = append(acls, r.Header.Get("X-Amz-Acl"))
+	}))
+	defer srv.Close()
+
+	fn := S3Storage(aws.Auth{AccessKey: "key", SecretKey: "secret"}, aws.Region{S3Endpoint: srv.URL}, S3Options{ACL: "private"})
+	u, _ := url.Parse("s3://bucket/pic.jpg")
+	s, err := fn(u, &defaultThumbnailer.codec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.(RawSaver).SaveRaw(strings.NewReader("jpeg")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Save(image.NewNRGBA(image.Rect(0, 0, 1, 1))); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.(S3Saver).SaveS3(strings.NewReader("jpeg"), S3Options{ACL: "public-read"}); err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"private", "private", "public-read"}; !reflect.DeepEqual(acls, expected) {
+		t.Fatalf("got: %v, expected: %v", acls, expected)
+	}
+}
+
+// fakeS3 is an S3 server keeping its objects in memory, by path.
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string]fakeS3Object
+	gets    int
+	puts    []string
+}
+
+type fakeS3Object struct {
+	data    []byte
+	modTime time.Time
+}
+
+func newFakeS3() *fakeS3 {
+	return &fakeS3{objects: map[string]fakeS3Object{}}
+}
+
+// put stores data at path, modified at modTime.
+func (f *fakeS3) put(path string, data []byte, modTime time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.objects[path] = fakeS3Object{data: data, modTime: modTime}
+}
+
+// uploads returns the paths of the objects put, in order.
+func (f *fakeS3) uploads() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.puts...)
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch r.Method {
+	case "PUT":
+		data, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		f.objects[r.URL.Path] = fakeS3Object{data: data, modTime: time.Now()}
+		f.puts = append(f.puts, r.URL.Path)
+	case "GET", "HEAD":
+		o, ok := f.objects[r.URL.Path]
+		if !ok {
+			http.Error(w, "NoSuchKey", http.StatusNotFound)
+			return
+		}
+		sum := sha256.Sum256(o.data)
+		w.Header().Set("Last-Modified", o.modTime.UTC().Format(http.TimeFormat))
+		w.Header().Set("ETag", `"`+hex.EncodeToString(sum[:16])+`"`)
+		w.Header().Set("Content-Length", strconv.Itoa(len(o.data)))
+		if r.Method == "GET" {
+			f.gets++
+			w.Write(o.data)
+		}
+	default:
+		http.Error(w, "Not implemented", http.StatusNotImplemented)
+	}
+}
+
+// s3Stack returns the s3:// storage of the commands sending its requests to
+// srv: S3Storage behind Retry and a DiskCache.
+func s3Stack(t *testing.T, srv *httptest.Server) StorageFunc {
+	cache, err := NewDiskCache(t.TempDir(), 64<<20, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s3 := S3Storage(aws.Auth{AccessKey: "key", SecretKey: "secret"}, aws.Region{S3Endpoint: srv.URL}, S3Options{})
+	return cache.Storage(Retry(context.Background(), s3, RetryPolicy{MaxAttempts: 2, BaseDelay: time.Millisecond}))
+}
@@ -1,40 +1,23 @@
 package thumbnailer
 
 import (
-	"bytes"
+	"errors"
 	"fmt"
 	"image"
+	"io"
 	"log"
 	"math"
-	"mime"
 	"net/url"
 	"os"
-	"path/filepath"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/disintegration/imaging"
-	"gopkg.in/amz.v1/aws"
-	"gopkg.in/amz.v1/s3"
 )
 
-var (
-	awsAuth aws.Auth
-	formats = map[string]imaging.Format{
-		".jpg":  imaging.JPEG,
-		".jpeg": imaging.JPEG,
-		".png":  imaging.PNG,
-		".tif":  imaging.TIFF,
-		".tiff": imaging.TIFF,
-		".bmp":  imaging.BMP,
-		".gif":  imaging.GIF,
-	}
-)
-
-func init() {
-	awsAuth = newAwsAuth()
-}
+// defaultThumbnailer is used by the package level functions.
+var defaultThumbnailer = New()
 
 // This function used internally to convert any image type to NRGBA if needed.
 // copied from `imaging`
@@ -48,112 +31,86 @@ func toNRGBA(img image.Image) *image.NRGBA {
 	return imaging.Clone(img)
 }
 
-func newAwsAuth() aws.Auth {
-	// Authenticate and Create an aws S3 service
-	auth, err := aws.EnvAuth()
-	if err != nil {
-		panic(err.Error())
-	}
-	return auth
+// Thumbnailer generates the thumbnails described by a ThumbnailerMessage.
+// Its configuration is set once by New, a Thumbnailer is safe for concurrent use.
+type Thumbnailer struct {
+	storages map[string]StorageFunc
+	codec    Codec
+	filter   Filter
+	limits   Limits
+	// nameTemplate is the default template used to name the thumbnails.
+	nameTemplate string
+	// sourceCache holds the decoded source images, nil means no cache.
+	sourceCache *SourceCache
+	// presets are the named ThumbnailOpts the messages refer to.
+	presets Presets
+	// s3Options are the default settings of the thumbnails uploaded to S3.
+	s3Options S3Options
+	// callbacks sends the callback requests of the messages.
+	callbacks *callbacks
+	logger    *log.Logger
+	// flights are the thumbnails being generated.
+	flights *flightGroup
+	// workers is a semaphore capping the number of thumbnails generated
+	// concurrently, nil means no cap.
+	workers chan struct{}
 }
 
-type imageOpenSaverError struct {
-	url *url.URL
-}
-
-func (e imageOpenSaverError) Error() string {
-	return fmt.Sprintf("imageOpenSaverError with URL:%v", e.url)
-}
-
-// ImageOpenSaver interface that can Open and Close images from a given backend:fs,  s3, ...
-type ImageOpenSaver interface {
-	Open() (image.Image, error)
-	Save(img image.Image) error
-}
-
-// filesystem implementation of the ImageOpenSaver interface
-type fsImageOpenSaver struct {
-	URL *url.URL
-}
-
-func (s fsImageOpenSaver) Open() (image.Image, error) {
-	file, err := os.Open(s.URL.Path)
-	if err != nil {
-		return nil, err
+// New returns a Thumbnailer configured with options. By default the file://
+// and s3:// schemes are supported, the s3 credentials are read from the
+// AWS environment variables.
+func New(options ...Option) *Thumbnailer {
+	t := &Thumbnailer{
+		storages: map[string]StorageFunc{
+			"file": FileStorage,
+			"s3":   EnvS3Storage,
+		},
+		codec:        Codec{Formats: defaultFormats(), Options: defaultEncodeOptions},
+		filter:       DefaultFilter,
+		nameTemplate: DefaultNameTemplate,
+		callbacks:    newCallbacks("", DefaultCallbackTimeout, DefaultRetryPolicy),
+		logger:       log.New(os.Stderr, "", log.LstdFlags),
+		flights:      &flightGroup{flights: map[string]*thumbFlight{}},
 	}
-	defer file.Close()
-	return Decode(file, filepath.Ext(s.URL.Path))
+	for _, option := range options {
+		option(t)
+	}
+	return t
 }
 
-// Save saves the image to file with the specified filename.
-// The format is determined from the filename extension: "jpg" (or "jpeg"), "png", "gif", "tif" (or "tiff") and "bmp" are supported.
-func (s fsImageOpenSaver) Save(img image.Image) error {
-	ext := strings.ToLower(filepath.Ext(s.URL.Path))
-	f, ok := formats[ext]
-	if !ok {
-		return imaging.ErrUnsupportedFormat
+// Clone returns a Thumbnailer configured as t and then with options. It
+// shares the workers of t, unless options changes their number, and the
+// thumbnails being generated, which are capped and coalesced together.
+func (t *Thumbnailer) Clone(options ...Option) *Thumbnailer {
+	c := *t
+	c.storages = make(map[string]StorageFunc, len(t.storages))
+	for scheme, fn := range t.storages {
+		c.storages[scheme] = fn
 	}
-
-	file, err := os.Create(s.URL.Path)
-	if err != nil {
-		return err
+	c.codec.Formats = make(map[string]imaging.Format, len(t.codec.Formats))
+	for ext, format := range t.codec.Formats {
+		c.codec.Formats[ext] = format
 	}
-	defer file.Close()
-
-	return Encode(file, img, f)
-}
-
-// s3 implementation of the s3ImageOpenSaver interface
-type s3ImageOpenSaver struct {
-	URL *url.URL
-}
-
-func (s s3ImageOpenSaver) Open() (image.Image, error) {
-	conn := s3.New(awsAuth, aws.USEast)
-	bucket := conn.Bucket(s.URL.Host)
-	reader, err := bucket.GetReader(s.URL.Path)
-	if err != nil {
-		return nil, err
+	for _, option := range options {
+		option(&c)
 	}
-
-	defer reader.Close()
-	return Decode(reader, filepath.Ext(s.URL.Path))
+	return &c
 }
 
-func (s s3ImageOpenSaver) Save(img image.Image) error {
-	var buffer bytes.Buffer
-	ext := strings.ToLower(filepath.Ext(s.URL.Path))
-	f, ok := formats[ext]
+// NewImageOpenSaver return the relevant implementation of ImageOpenSaver based on
+// the url.Scheme
+func (t *Thumbnailer) NewImageOpenSaver(url *url.URL) (ImageOpenSaver, error) {
+	fn, ok := t.storages[url.Scheme]
 	if !ok {
-		return imaging.ErrUnsupportedFormat
-	}
-	err := imaging.Encode(&buffer, img, f)
-	if err != nil {
-		log.Println("An error occured while encoding ", s.URL)
-		return err
-	}
-	conn := s3.New(awsAuth, aws.USEast)
-	bucket := conn.Bucket(s.URL.Host)
-
-	err = bucket.Put(s.URL.Path, buffer.Bytes(), mime.TypeByExtension(ext), s3.PublicRead)
-	if err != nil {
-		log.Println("An error occured while putting on S3", s.URL)
-		return err
+		return nil, imageOpenSaverError{url}
 	}
-	return nil
+	return fn(url, &t.codec)
 }
 
 // NewImageOpenSaver return the relevant implementation of ImageOpenSaver based on
-// the url.Scheme
+// the url.Scheme using the default Thumbnailer.
 func NewImageOpenSaver(url *url.URL) (ImageOpenSaver, error) {
-	switch url.Scheme {
-	case "file":
-		return &fsImageOpenSaver{url}, nil
-	case "s3":
-		return &s3ImageOpenSaver{url}, nil
-	default:
-		return nil, imageOpenSaverError{url}
-	}
+	return defaultThumbnailer.NewImageOpenSaver(url)
 }
 
 type rectangle struct {
@@ -170,191 +127,584 @@ func (r *rectangle) newImageRect() image.Rectangle {
 }
 
 type ThumbnailOpt struct {
-	DstImage string     `json:"dstImage,omitempty"`
-	Rect     *rectangle `json:"rect,omitempty"`
-	Width    int        `json:"width"`
-	Height   int        `json:"height"`
+	DstImage string `json:"dstImage,omitempty"`
+	// DstImages are other URLs the thumbnail is saved to.
+	DstImages []string   `json:"dstImages,omitempty"`
+	Rect      *rectangle `json:"rect,omitempty"`
+	Width     int        `json:"width"`
+	Height    int        `json:"height"`
+	// Filter is the resampling filter, the Thumbnailer default is used when empty.
+	Filter Filter `json:"filter,omitempty"`
 }
 
+// Overwrite tells what to do when a thumbnail already exists.
+type Overwrite string
+
+const (
+	// OverwriteAlways regenerates the existing thumbnails, it is the default.
+	OverwriteAlways Overwrite = "always"
+	// OverwriteNever keeps the existing thumbnails.
+	OverwriteNever Overwrite = "never"
+	// OverwriteIfOlder regenerates the thumbnails older than their source.
+	OverwriteIfOlder Overwrite = "if-older"
+)
+
 type ThumbnailerMessage struct {
-	SrcImage  string         `json:"srcImage"`
-	DeleteSrc bool           `json:"deleteSrc",omitempty"`
-	DstFolder string         `json:"dstFolder"`
-	Opts      []ThumbnailOpt `json:"opts"`
+	SrcImage  string `json:"srcImage"`
+	DeleteSrc bool   `json:"deleteSrc,omitempty"`
+	DstFolder string `json:"dstFolder"`
+	// DstFolders are other folders the thumbnails are saved to, each
+	// thumbnail is encoded once and written to all of them.
+	DstFolders []string       `json:"dstFolders,omitempty"`
+	Opts       []ThumbnailOpt `json:"opts"`
+	// Presets are the names of the Presets of the Thumbnailer added to Opts.
+	Presets   []string  `json:"presets,omitempty"`
+	Overwrite Overwrite `json:"overwrite,omitempty"`
+	// NameTemplate is the template, or the name of a preset, used to name
+	// the thumbnails saved in DstFolder. See DefaultNameTemplate.
+	NameTemplate string `json:"nameTemplate,omitempty"`
+	// S3 overrides the S3Options of the Thumbnailer for the thumbnails
+	// uploaded to S3.
+	S3 *S3Options `json:"s3,omitempty"`
+	// CallbackURL receives a Callback once the message is processed by
+	// Process, whether it succeeded or failed.
+	CallbackURL string `json:"callbackURL,omitempty"`
+	// AllowDestination, when set, is called with the URL of every thumbnail
+	// once named, none of them is saved unless it returns nil for all of them.
+	AllowDestination func(thumbURL *url.URL) error `json:"-"`
 }
 
 type ThumbnailResult struct {
 	Thumbnail *url.URL
 	Err       error
+	// Skipped is set when the existing thumbnail has been kept.
+	Skipped bool
+	// SourceHash is the hex encoded SHA-256 of the source image, it is
+	// empty when the backend of the source does not give access to its bytes.
+	SourceHash string
+}
+
+// dstFolders returns the folders the thumbnails of tm are saved to.
+func (tm *ThumbnailerMessage) dstFolders() []string {
+	if tm.DstFolder == "" && len(tm.DstFolders) > 0 {
+		return tm.DstFolders
+	}
+	return append([]string{tm.DstFolder}, tm.DstFolders...)
 }
 
-func (tm *ThumbnailerMessage) thumbURL(opt ThumbnailOpt) (*url.URL, error) {
-	baseName := filepath.Base(tm.SrcImage)
+// dstImages returns the URLs the thumbnail of opt is saved to, when they are
+// set they replace the DstFolder.
+func (opt ThumbnailOpt) dstImages() []string {
 	if opt.DstImage == "" {
-		fURL, err := url.Parse(tm.DstFolder)
+		return opt.DstImages
+	}
+	return append([]string{opt.DstImage}, opt.DstImages...)
+}
+
+// Destinations returns the folders and the URLs the thumbnails of tm are
+// saved to, without duplicates.
+func (tm *ThumbnailerMessage) Destinations() []string {
+	var dsts []string
+	seen := map[string]bool{}
+	add := func(urls []string) {
+		for _, u := range urls {
+			if !seen[u] {
+				seen[u] = true
+				dsts = append(dsts, u)
+			}
+		}
+	}
+	for _, opt := range tm.Opts {
+		if dstImages := opt.dstImages(); len(dstImages) > 0 {
+			add(dstImages)
+		} else {
+			add(tm.dstFolders())
+		}
+	}
+	return dsts
+}
+
+// thumbURLs returns the URLs of the thumbnail of opt, one per DstImage or
+// one per folder named after tmpl. srcHash is the hash of the source image,
+// it is required by the templates using it.
+func (tm *ThumbnailerMessage) thumbURLs(opt ThumbnailOpt, tmpl, srcHash string) ([]*url.URL, error) {
+	var urls []*url.URL
+	if dstImages := opt.dstImages(); len(dstImages) > 0 {
+		for _, dstImage := range dstImages {
+			fURL, err := url.Parse(dstImage)
+			if err != nil {
+				return nil, fmt.Errorf("An error occured while parsing the DstImage %s", err)
+			}
+			urls = append(urls, fURL)
+		}
+		return urls, nil
+	}
+	if srcHash == "" && needsSourceHash(tmpl) {
+		return nil, fmt.Errorf("The hash of the SrcImage %s is not available for the name template %q", tm.SrcImage, tmpl)
+	}
+	for _, folder := range tm.dstFolders() {
+		fURL, err := url.Parse(folder)
 		if err != nil {
 			return nil, fmt.Errorf("An error occured while parsing the DstFolder %s", err)
 		}
-		// TODO (yml): I am pretty sure that we do not really want to always do this.
-		ext := filepath.Ext(tm.SrcImage)
-		baseName = strings.TrimSuffix(baseName, ext)
-		ext = strings.ToLower(ext)
-
-		if opt.Rect != nil {
-			fURL.Path = filepath.Join(
-				fURL.Path,
-				fmt.Sprintf("%s_c%d-%d-%d-%d_s%dx%d%s", baseName, opt.Rect.Min[0], opt.Rect.Min[1], opt.Rect.Max[0], opt.Rect.Max[1], opt.Width, opt.Height, ext))
-		} else if opt.Width == 0 && opt.Height == 0 {
-			fURL.Path = filepath.Join(fURL.Path, baseName)
-		} else {
-			fURL.Path = filepath.Join(fURL.Path, fmt.Sprintf("%s_s%dx%d%s", baseName, opt.Width, opt.Height, ext))
+		fURL.Path = tm.thumbName(tmpl, fURL.Path, srcHash, opt)
+		urls = append(urls, fURL)
+	}
+	return urls, nil
+}
+
+// allowDestinations checks the URLs of the thumbnails of tm with its
+// AllowDestination.
+func (tm *ThumbnailerMessage) allowDestinations(allURLs [][]*url.URL) error {
+	if tm.AllowDestination == nil {
+		return nil
+	}
+	for _, thumbURLs := range allURLs {
+		for _, thumbURL := range thumbURLs {
+			if err := tm.AllowDestination(thumbURL); err != nil {
+				return err
+			}
 		}
-		return fURL, nil
-	} else {
-		fURL, err := url.Parse(opt.DstImage)
+	}
+	return nil
+}
+
+// allThumbURLs returns the URLs of the thumbnails of opts. An error is
+// returned when two thumbnails, or a thumbnail and the source image, share a
+// URL.
+func (tm *ThumbnailerMessage) allThumbURLs(opts []ThumbnailOpt, tmpl, srcHash string) ([][]*url.URL, error) {
+	allURLs := make([][]*url.URL, 0, len(opts))
+	seen := map[string]bool{}
+	if sURL, err := url.Parse(tm.SrcImage); err == nil {
+		seen[sURL.String()] = true
+	}
+	for _, opt := range opts {
+		thumbURLs, err := tm.thumbURLs(opt, tmpl, srcHash)
 		if err != nil {
-			return nil, fmt.Errorf("An error occured while parsing the DstImage %s", err)
+			return nil, err
+		}
+		for _, thumbURL := range thumbURLs {
+			if seen[thumbURL.String()] {
+				return nil, fmt.Errorf("Several thumbnails or the SrcImage would be saved to %s", thumbURL)
+			}
+			seen[thumbURL.String()] = true
 		}
-		return fURL, nil
+		allURLs = append(allURLs, thumbURLs)
 	}
+	return allURLs, nil
 }
 
-func (tm *ThumbnailerMessage) Open() (image.Image, error) {
+// ErrLimitExceeded is returned when a ThumbnailerMessage exceeds the Limits of the Thumbnailer.
+var ErrLimitExceeded = errors.New("thumbnailer: limit exceeded")
+
+// Validate checks tm as Process does before generating the thumbnails, the
+// errors due to the Limits wrap ErrLimitExceeded. The presets of tm are
+// replaced by their Opts.
+func (t *Thumbnailer) Validate(tm *ThumbnailerMessage) error {
+	return t.validate(tm)
+}
+
+// validate checks that tm is within the limits of t and normalizes the
+// filter names of its options.
+func (t *Thumbnailer) validate(tm *ThumbnailerMessage) error {
+	if _, err := ParseFilter(string(t.filter)); err != nil {
+		return err
+	}
+	if _, err := t.nameTemplateOf(tm); err != nil {
+		return err
+	}
+	switch tm.Overwrite {
+	case "", OverwriteAlways, OverwriteNever, OverwriteIfOlder:
+	default:
+		return fmt.Errorf("Unsupported overwrite value: %q", tm.Overwrite)
+	}
+	if err := t.s3Options.merge(tm.S3).Validate(); err != nil {
+		return err
+	}
+	if tm.CallbackURL != "" {
+		if _, err := parseCallbackURL(tm.CallbackURL); err != nil {
+			return err
+		}
+	}
+	if len(tm.Presets) > 0 {
+		opts, err := t.presets.Opts(tm.Presets)
+		if err != nil {
+			return err
+		}
+		tm.Opts = append(tm.Opts, opts...)
+		tm.Presets = nil
+	}
+	for i, opt := range tm.Opts {
+		if opt.Filter == "" {
+			continue
+		}
+		f, err := ParseFilter(string(opt.Filter))
+		if err != nil {
+			return err
+		}
+		tm.Opts[i].Filter = f
+	}
+	if t.limits.MaxOpts > 0 && len(tm.Opts) > t.limits.MaxOpts {
+		return fmt.Errorf("%w: %d opts requested, max is %d", ErrLimitExceeded, len(tm.Opts), t.limits.MaxOpts)
+	}
+	for _, opt := range tm.Opts {
+		if err := t.checkSize(opt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkSize checks the size of opt against the limits of t. The sizes left
+// to 0 are only known, and checked again, once opt is resolved.
+func (t *Thumbnailer) checkSize(opt ThumbnailOpt) error {
+	if t.limits.MaxWidth > 0 && opt.Width > t.limits.MaxWidth {
+		return fmt.Errorf("%w: width %d requested, max is %d", ErrLimitExceeded, opt.Width, t.limits.MaxWidth)
+	}
+	if t.limits.MaxHeight > 0 && opt.Height > t.limits.MaxHeight {
+		return fmt.Errorf("%w: height %d requested, max is %d", ErrLimitExceeded, opt.Height, t.limits.MaxHeight)
+	}
+	return nil
+}
+
+// CheckImage checks that the image read from r is encoded in the format
+// supported for its extension ext, only its header is decoded.
+func (t *Thumbnailer) CheckImage(r io.Reader, ext string) error {
+	f, err := t.codec.Format(ext)
+	if err != nil {
+		return fmt.Errorf("Unsupported image extension %q: %w", ext, err)
+	}
+	_, format, err := image.DecodeConfig(r)
+	if err != nil {
+		return fmt.Errorf("An error occured while decoding the image: %w", err)
+	}
+	if !strings.EqualFold(format, f.String()) {
+		return fmt.Errorf("The %s image has the extension %q", format, ext)
+	}
+	return nil
+}
+
+// Open opens and decodes tm.SrcImage.
+func (t *Thumbnailer) Open(tm *ThumbnailerMessage) (image.Image, error) {
 	sURL, err := url.Parse(tm.SrcImage)
 	if err != nil {
 		return nil, err
 	}
-	src, err := NewImageOpenSaver(sURL)
+	src, err := t.NewImageOpenSaver(sURL)
 	if err != nil {
 		return nil, err
 	}
 	return src.Open()
 }
 
-// Resize the src image to the biggest thumb sizes in tm.opts.
-func (tm *ThumbnailerMessage) maxThumbnail(src image.Image) image.Image {
-	maxW, maxH := 0, 0
-	srcW := src.Bounds().Max.X
-	srcH := src.Bounds().Max.Y
-	for _, opt := range tm.Opts {
-		dstW, dstH := opt.Width, opt.Height
-		// if new width or height is 0 then preserve aspect ratio, minimum 1px
-		if dstW == 0 {
-			tmpW := float64(dstH) * float64(srcW) / float64(srcH)
-			dstW = int(math.Max(1.0, math.Floor(tmpW+0.5)))
-		}
-		if dstH == 0 {
-			tmpH := float64(dstW) * float64(srcH) / float64(srcW)
-			dstH = int(math.Max(1.0, math.Floor(tmpH+0.5)))
-		}
-		if dstW > maxW {
-			maxW = dstW
+// Open opens and decodes tm.SrcImage with the default Thumbnailer.
+func (tm *ThumbnailerMessage) Open() (image.Image, error) {
+	return defaultThumbnailer.Open(tm)
+}
+
+// sizeHint returns the minimum size at which the source image, of the given
+// bounds, must be decoded to generate the thumbnails of opts.
+func (t *Thumbnailer) sizeHint(opts []ThumbnailOpt, bounds image.Rectangle) image.Point {
+	scale := 0.0
+	for _, opt := range opts {
+		s := 1.0
+		// NearestNeighbor needs the original pixels
+		if (opt.Width != 0 || opt.Height != 0) && t.filterOf(opt) != NearestNeighbor {
+			s = math.Min(1, thumbScale(bounds, opt)*pyramidOversample)
 		}
-		if dstH > maxH {
-			maxH = dstH
+		scale = math.Max(scale, s)
+	}
+	return image.Pt(
+		int(math.Ceil(float64(bounds.Dx())*scale)),
+		int(math.Ceil(float64(bounds.Dy())*scale)))
+}
+
+// newPyramid returns the pyramid used to generate the thumbnails of opts from
+// src, the decoded source image of the given bounds. Its levels are only
+// built when several thumbnails can share them.
+func (t *Thumbnailer) newPyramid(opts []ThumbnailOpt, src *image.NRGBA, bounds image.Rectangle) *pyramid {
+	scales := make([]float64, 0, len(opts))
+	for _, opt := range opts {
+		if t.filterOf(opt) == t.filter && (opt.Width != 0 || opt.Height != 0) {
+			scales = append(scales, thumbScale(bounds, opt))
 		}
 	}
-	fmt.Println("thumbnail max: ", maxW, maxH, "for :", tm.Opts)
-	return imaging.Resize(src, maxW, maxH, imaging.CatmullRom)
+	if len(scales) < 2 {
+		return &pyramid{bounds: bounds, src: src, filter: t.filter}
+	}
+	p := newPyramid(src, bounds, t.filter, scales)
+	t.logger.Println("thumbnail pyramid: ", p, "for :", opts)
+	return p
 }
 
-func (tm *ThumbnailerMessage) generateThumbnail(img image.Image, opt ThumbnailOpt) ThumbnailResult {
-	timerStart := time.Now()
-	var thumbImg *image.NRGBA
-	if opt.Rect != nil {
-		img = imaging.Crop(img, opt.Rect.newImageRect())
+// nameTemplateOf returns the template used to name the thumbnails of tm.
+func (t *Thumbnailer) nameTemplateOf(tm *ThumbnailerMessage) (string, error) {
+	if tm.NameTemplate != "" {
+		return ParseNameTemplate(tm.NameTemplate)
 	}
+	return ParseNameTemplate(t.nameTemplate)
+}
 
-	if opt.Width == 0 && opt.Height == 0 {
-		thumbImg = toNRGBA(img)
-	} else {
-		thumbImg = imaging.Resize(img, opt.Width, opt.Height, imaging.CatmullRom)
+// filterOf returns the resampling filter used for opt.
+func (t *Thumbnailer) filterOf(opt ThumbnailOpt) Filter {
+	if opt.Filter == "" {
+		return t.filter
 	}
+	return opt.Filter
+}
 
+// resolveOpt returns opt with its filter and its size, computed from the
+// bounds of the source image, filled in. The thumbnail names are built from it.
+func (t *Thumbnailer) resolveOpt(opt ThumbnailOpt, bounds image.Rectangle) ThumbnailOpt {
+	opt.Filter = t.filterOf(opt)
 	// TODO (yml) not sure we always want to do this
-	thumBounds := thumbImg.Bounds()
-	if opt.Width == 0 {
-		opt.Width = thumBounds.Max.X
-	}
-	if opt.Height == 0 {
-		opt.Height = thumBounds.Max.Y
+	if region := thumbRegion(bounds, opt); !region.Empty() {
+		opt.Width, opt.Height = thumbSize(region.Dx(), region.Dy(), opt)
 	}
+	return opt
+}
 
-	thumbURL, err := tm.thumbURL(opt)
+// upToDate tells if the thumbnail stored at thumbURL can be kept according
+// to tm.Overwrite.
+func (t *Thumbnailer) upToDate(tm *ThumbnailerMessage, src *source, thumbURL *url.URL) bool {
+	if tm.Overwrite == "" || tm.Overwrite == OverwriteAlways {
+		return false
+	}
+	thumb, err := t.NewImageOpenSaver(thumbURL)
 	if err != nil {
-		log.Println("An error occured while contstructing thumbURL for", tm.SrcImage, err)
+		return false
 	}
-	timerThumbDone := time.Now()
-	log.Println("thumb :", thumbURL, " generated in : ", timerThumbDone.Sub(timerStart))
-
-	timerSaveStart := time.Now()
-	thumb, err := NewImageOpenSaver(thumbURL)
+	stater, ok := thumb.(Stater)
+	if !ok {
+		return false
+	}
+	thumbInfo, err := stater.Stat()
 	if err != nil {
-		log.Println("An error occured while creating an instance of ImageOpenSaver for", thumbURL, err)
-		return ThumbnailResult{nil, err}
+		if !os.IsNotExist(err) {
+			t.logger.Println("An error occured while checking", thumbURL, err)
+		}
+		return false
+	}
+	if tm.Overwrite == OverwriteNever {
+		return true
 	}
-	err = thumb.Save(thumbImg)
+	srcStater, ok := src.opener.(Stater)
+	if !ok {
+		return false
+	}
+	srcInfo, err := srcStater.Stat()
 	if err != nil {
-		log.Println("An error occured while saving,", thumbURL, err)
-		return ThumbnailResult{nil, err}
+		t.logger.Println("An error occured while checking", tm.SrcImage, err)
+		return false
 	}
-	timerEnd := time.Now()
-	log.Println("thumb :", thumbURL, " saved in : ", timerEnd.Sub(timerSaveStart))
-	return ThumbnailResult{thumbURL, nil}
+	return thumbInfo.ModTime.After(srcInfo.ModTime)
 }
 
-func (tm *ThumbnailerMessage) GenerateThumbnails() <-chan ThumbnailResult {
+func (t *Thumbnailer) generateThumbnail(tm *ThumbnailerMessage, p *pyramid, opt ThumbnailOpt, thumbURLs []*url.URL) []ThumbnailResult {
+	if t.workers != nil {
+		t.workers <- struct{}{}
+		defer func() { <-t.workers }()
+	}
+	timerStart := time.Now()
+	thumbImg, err := p.thumbnail(opt, opt.Filter)
+	if err != nil {
+		t.logger.Println("An error occured while resizing", tm.SrcImage, err)
+		results := make([]ThumbnailResult, 0, len(thumbURLs))
+		for _, thumbURL := range thumbURLs {
+			results = append(results, ThumbnailResult{Thumbnail: thumbURL, Err: err})
+		}
+		return results
+	}
+	t.logger.Println("thumb :", thumbURLs[0], " generated in : ", time.Since(timerStart))
+	return t.saveThumbnail(tm, thumbImg, thumbURLs)
+}
+
+// GenerateThumbnails generates the thumbnails described by tm. The results are
+// sent on the returned channel which is closed once all the thumbnails are done.
+func (t *Thumbnailer) GenerateThumbnails(tm *ThumbnailerMessage) <-chan ThumbnailResult {
 	resultChan := make(chan ThumbnailResult)
 	go func(rc chan<- ThumbnailResult) {
 		defer close(rc)
-		img, err := tm.Open()
+		if err := t.validate(tm); err != nil {
+			t.logger.Println("Invalid thumbnailer message for", tm.SrcImage, err)
+			rc <- ThumbnailResult{Err: err}
+			return
+		}
+		src, err := t.openSource(tm)
 		if err != nil {
-			log.Println("An error occured while opening SrcImage", tm.SrcImage, err)
-			rc <- ThumbnailResult{nil, err}
+			t.logger.Println("An error occured while opening SrcImage", tm.SrcImage, err)
+			rc <- ThumbnailResult{Err: err}
 			return
 		}
-		// From now on we will deal with an NRGBA image
-		img = toNRGBA(img)
+		defer src.Close()
 
-		var maxThumb image.Image
-		if len(tm.Opts) > 1 {
-			// The resized image will be used to generate all the thumbs
-			maxThumb = tm.maxThumbnail(img)
+		// The thumbnails are named before decoding the source, so the ones
+		// already up to date are skipped without decoding it.
+		resolved := make([]ThumbnailOpt, 0, len(tm.Opts))
+		for _, opt := range tm.Opts {
+			opt = t.resolveOpt(opt, src.bounds)
+			if err := t.checkSize(opt); err != nil {
+				t.logger.Println("Invalid thumbnailer message for", tm.SrcImage, err)
+				rc <- ThumbnailResult{Err: err}
+				return
+			}
+			resolved = append(resolved, opt)
+		}
+		tmpl, _ := t.nameTemplateOf(tm)
+		if needsSourceHash(tmpl) {
+			// The whole source is read to name the thumbnails after its content
+			if err := src.readAll(); err != nil {
+				t.logger.Println("An error occured while reading SrcImage", tm.SrcImage, err)
+				rc <- ThumbnailResult{Err: err}
+				return
+			}
+		}
+		allURLs, err := tm.allThumbURLs(resolved, tmpl, src.sum())
+		if err != nil {
+			t.logger.Println("An error occured while contstructing thumbURL for", tm.SrcImage, err)
+			rc <- ThumbnailResult{Err: err}
+			return
+		}
+		if err := tm.allowDestinations(allURLs); err != nil {
+			t.logger.Println("Thumbnail not allowed for", tm.SrcImage, err)
+			rc <- ThumbnailResult{Err: err}
+			return
+		}
+		opts := make([]ThumbnailOpt, 0, len(resolved))
+		thumbURLs := make([][]*url.URL, 0, len(resolved))
+		for i, opt := range resolved {
+			var stale []*url.URL
+			for _, thumbURL := range allURLs[i] {
+				if t.upToDate(tm, src, thumbURL) {
+					t.logger.Println("thumb :", thumbURL, " skipped")
+					rc <- ThumbnailResult{Thumbnail: thumbURL, Skipped: true, SourceHash: src.sum()}
+					continue
+				}
+				stale = append(stale, thumbURL)
+			}
+			if len(stale) > 0 {
+				opts = append(opts, opt)
+				thumbURLs = append(thumbURLs, stale)
+			}
 		}
 
+		// The thumbnails already being generated by a concurrent request
+		// are waited for instead
 		var wg sync.WaitGroup
-		for _, opt := range tm.Opts {
+		defer wg.Wait()
+		opts, thumbURLs, flights := t.coalesce(rc, &wg, tm, src, opts, thumbURLs)
+		// The flights are finished before sending to rc, so the waiters
+		// are not blocked by a caller no longer reading it.
+		publish := func(i int, results []ThumbnailResult) {
+			t.flights.finish(flights[i], results)
+			for _, result := range results {
+				rc <- result
+			}
+		}
+		if len(opts) == 0 {
+			return
+		}
+
+		img, err := src.decode(&t.codec, t.sizeHint(opts, src.bounds))
+		if err != nil {
+			t.logger.Println("An error occured while decoding SrcImage", tm.SrcImage, err)
+			failed := make([][]ThumbnailResult, len(thumbURLs))
+			for i, urls := range thumbURLs {
+				for _, thumbURL := range urls {
+					failed[i] = append(failed[i], ThumbnailResult{Thumbnail: thumbURL, Err: err})
+				}
+				t.flights.finish(flights[i], failed[i])
+			}
+			for _, results := range failed {
+				for _, result := range results {
+					rc <- result
+				}
+			}
+			return
+		}
+		if img.Bounds().Size() != src.bounds.Size() {
+			t.logger.Println("SrcImage", tm.SrcImage, src.bounds.Size(), "decoded at", img.Bounds().Size())
+		}
+		// From now on we will deal with an NRGBA image
+		p := t.newPyramid(opts, toNRGBA(img), src.bounds)
+		srcHash := src.sum()
+
+		for i, opt := range opts {
 			wg.Add(1)
-			// TODO (yml) cap the number goroutines
-			go func(out chan<- ThumbnailResult, opt ThumbnailOpt) {
+			go func(i int, opt ThumbnailOpt) {
 				defer wg.Done()
-				if opt.Rect == nil && maxThumb != nil {
-					out <- tm.generateThumbnail(maxThumb, opt)
-				} else {
-					// we can't use the maxThumb optimization
-					out <- tm.generateThumbnail(img, opt)
+				results := t.generateThumbnail(tm, p, opt, thumbURLs[i])
+				for j := range results {
+					results[j].SourceHash = srcHash
 				}
-			}(rc, opt)
+				publish(i, results)
+			}(i, opt)
 		}
-		wg.Wait()
-		return
 	}(resultChan)
 	return resultChan
 }
 
-func (tm *ThumbnailerMessage) DeleteImage() error {
+// GenerateThumbnails generates the thumbnails described by tm with the default Thumbnailer.
+func (tm *ThumbnailerMessage) GenerateThumbnails() <-chan ThumbnailResult {
+	return defaultThumbnailer.GenerateThumbnails(tm)
+}
+
+// Process generates the thumbnails described by tm and waits for them. An error
+// is returned if at least one of them failed, otherwise tm.SrcImage is deleted
+// when tm.DeleteSrc is set. The outcome is then posted to tm.CallbackURL in
+// the background.
+func (t *Thumbnailer) Process(tm *ThumbnailerMessage) ([]ThumbnailResult, error) {
+	results, err := t.process(tm)
+	if tm.CallbackURL != "" {
+		go func(callbackURL string, callback Callback) {
+			if err := t.Notify(callbackURL, callback); err != nil {
+				t.logger.Println("An error occured while posting the callback to", callbackURL, err)
+			}
+		}(tm.CallbackURL, newCallback(tm, results, err))
+	}
+	return results, err
+}
+
+func (t *Thumbnailer) process(tm *ThumbnailerMessage) ([]ThumbnailResult, error) {
+	results := make([]ThumbnailResult, 0, len(tm.Opts))
+	for result := range t.GenerateThumbnails(tm) {
+		results = append(results, result)
+	}
+
+	for _, result := range results {
+		if result.Err != nil {
+			return results, fmt.Errorf("Error: At least one thumb generation failed - %w", result.Err)
+		}
+	}
+
+	if tm.DeleteSrc {
+		t.logger.Println("Deleting", tm.SrcImage)
+		if err := t.DeleteImage(tm); err != nil {
+			return results, err
+		}
+	}
+	return results, nil
+}
+
+// DeleteImage deletes tm.SrcImage.
+func (t *Thumbnailer) DeleteImage(tm *ThumbnailerMessage) error {
 	sURL, err := url.Parse(tm.SrcImage)
 	if err != nil {
-		log.Println("An error occured while parsing the SrcImage", tm.SrcImage, err)
+		t.logger.Println("An error occured while parsing the SrcImage", tm.SrcImage, err)
 		return err
 	}
-	if sURL.Scheme == "file" {
-		err := os.Remove(sURL.Path)
-		if err != nil {
-			return fmt.Errorf("Failed to remove %s,%s", sURL.Path, err)
-		}
-	} else {
+	src, err := t.NewImageOpenSaver(sURL)
+	if err != nil {
+		return err
+	}
+	d, ok := src.(Deleter)
+	if !ok {
 		return fmt.Errorf("DeleteImage is not implemented for %s", tm.SrcImage)
 	}
-	return nil
+	return d.Delete()
+}
+
+// DeleteImage deletes tm.SrcImage with the default Thumbnailer.
+func (tm *ThumbnailerMessage) DeleteImage() error {
+	return defaultThumbnailer.DeleteImage(tm)
 }
@@ -1,17 +1,27 @@
 package thumbnailer
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"image"
+	"io/ioutil"
 	"log"
+	"net/http/httptest"
+	"net/url"
 	"os"
 	"path/filepath"
+	"reflect"
 	"testing"
+	"time"
 )
 
 func testThumbnailerMessage() ThumbnailerMessage {
 	pwd, err := os.Getwd()
 	if err != nil {
-		log.Fatal("Failed to get the current directory: %s", err)
+		log.Fatalf("Failed to get the current directory: %s", err)
 	}
 	fmt.Println("Current dir:", pwd)
 	opt := ThumbnailOpt{Width: 100, Height: 100}
@@ -27,40 +37,52 @@ func testThumbnailerMessage() ThumbnailerMessage {
 func Test_thumbURL(t *testing.T) {
 	expected := "/tmp/pic_s100x100.jpg"
 	tm := testThumbnailerMessage()
-	url, err := tm.thumbURL(tm.Opts[0])
+	urls, err := tm.thumbURLs(tm.Opts[0], DefaultNameTemplate, "")
 	if err != nil {
 		t.Fatal("Failed to generate the thumbURL :", err)
 	}
-	if url.Path != expected {
-		t.Fatalf("got: %s, expected: %s", url.Path, expected)
+	if len(urls) != 1 || urls[0].Path != expected {
+		t.Fatalf("got: %v, expected: %s", urls, expected)
 	}
 }
 
 func Test_generateThumbnail(t *testing.T) {
+	th := New()
 	tm := testThumbnailerMessage()
-	src, err := tm.Open()
+	src, err := th.Open(&tm)
 	if err != nil {
 		t.Fatalf("Failed to open tm.SrcImage: %v", err)
 	}
-	result := tm.generateThumbnail(src, tm.Opts[0])
+	opt := th.resolveOpt(tm.Opts[0], src.Bounds())
+	thumbURLs, err := tm.thumbURLs(opt, DefaultNameTemplate, "")
+	if err != nil {
+		t.Fatal("Failed to generate the thumbURL :", err)
+	}
+	results := th.generateThumbnail(&tm, &pyramid{bounds: src.Bounds(), src: toNRGBA(src)}, opt, thumbURLs)
 	// Clean up the generated thumb
-	if err := os.Remove(result.Thumbnail.Path); err != nil {
+	if err := os.Remove(results[0].Thumbnail.Path); err != nil {
 		t.Fatal("Failed to delete the generated thumb:", err)
 	}
 }
 
 func Benchmark_generateThumbnail(b *testing.B) {
+	th := New()
 	tm := testThumbnailerMessage()
-	src, err := tm.Open()
+	src, err := th.Open(&tm)
 	if err != nil {
 		b.Fatalf("Failed to open tm.SrcImage: %v", err)
 	}
-	var result ThumbnailResult
+	opt := th.resolveOpt(tm.Opts[0], src.Bounds())
+	thumbURLs, err := tm.thumbURLs(opt, DefaultNameTemplate, "")
+	if err != nil {
+		b.Fatal("Failed to generate the thumbURL :", err)
+	}
+	var results []ThumbnailResult
 	for n := 0; n < b.N; n++ {
-		result = tm.generateThumbnail(src, tm.Opts[0])
+		results = th.generateThumbnail(&tm, &pyramid{bounds: src.Bounds(), src: toNRGBA(src)}, opt, thumbURLs)
 	}
 	// Clean up the generated thumb
-	if err := os.Remove(result.Thumbnail.Path); err != nil {
+	if err := os.Remove(results[0].Thumbnail.Path); err != nil {
 		b.Fatal("Failed to delete the generated thumb:", err)
 	}
 
@@ -79,3 +101,521 @@ func Test_GenerateThumbnails(t *testing.T) {
 		}
 	}
 }
+
+func Test_ThumbnailerInstances(t *testing.T) {
+	dir, err := ioutil.TempDir("", "thumbnailer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	small := New(WithEncodeOptions(EncodeOptions{JPEGQuality: 10}), WithWorkers(1))
+	large := New(WithEncodeOptions(EncodeOptions{JPEGQuality: 100}))
+	sizes := make(map[*Thumbnailer]int64)
+	for _, th := range []*Thumbnailer{small, large} {
+		tm := testThumbnailerMessage()
+		tm.Opts[0].DstImage = fmt.Sprintf("file://%s/%p.jpg", dir, th)
+		results, err := th.Process(&tm)
+		if err != nil {
+			t.Fatal("An error occured while generating a thumb :", err)
+		}
+		fi, err := os.Stat(results[0].Thumbnail.Path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sizes[th] = fi.Size()
+	}
+	if sizes[small] >= sizes[large] {
+		t.Fatalf("expected quality 10 to be smaller than quality 100, got %d >= %d", sizes[small], sizes[large])
+	}
+}
+
+func Test_ThumbnailerLimits(t *testing.T) {
+	th := New(WithLimits(Limits{MaxWidth: 50}))
+	tm := testThumbnailerMessage()
+	_, err := th.Process(&tm)
+	if !errors.Is(err, ErrLimitExceeded) {
+		t.Fatalf("expected ErrLimitExceeded, got: %v", err)
+	}
+
+	th = New(WithLimits(Limits{MaxOpts: 2}), WithPresets(Presets{"avatar": {Width: 64, Height: 64}}))
+	tm = testThumbnailerMessage()
+	tm.Presets = []string{"avatar"}
+	if err := th.Validate(&tm); err != nil {
+		t.Fatal(err)
+	}
+	if len(tm.Opts) != 2 || tm.Presets != nil {
+		t.Fatalf("expected the preset to be resolved, got: %v %v", tm.Opts, tm.Presets)
+	}
+	tm.Presets = []string{"avatar"}
+	if err := th.Validate(&tm); !errors.Is(err, ErrLimitExceeded) {
+		t.Fatalf("expected ErrLimitExceeded, got: %v", err)
+	}
+	tm.Presets = []string{"hero"}
+	if err := th.Validate(&tm); err == nil || errors.Is(err, ErrLimitExceeded) {
+		t.Fatalf("expected an unknown preset error, got: %v", err)
+	}
+
+	// The sizes left to 0 are checked once resolved, pic.jpg is 1632x1224
+	th = New(WithLimits(Limits{MaxWidth: 100, MaxHeight: 500}))
+	for _, opt := range []ThumbnailOpt{{}, {Height: 100}} {
+		tm = testThumbnailerMessage()
+		tm.Opts = []ThumbnailOpt{opt}
+		if err := th.Validate(&tm); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := th.Process(&tm); !errors.Is(err, ErrLimitExceeded) {
+			t.Fatalf("expected ErrLimitExceeded for %+v, got: %v", opt, err)
+		}
+	}
+}
+
+func Test_thumbURLFilter(t *testing.T) {
+	tm := testThumbnailerMessage()
+	for filter, expected := range map[Filter]string{
+		"":              "/tmp/pic_s100x100.jpg",
+		DefaultFilter:   "/tmp/pic_s100x100.jpg",
+		NearestNeighbor: "/tmp/pic_s100x100_nearestneighbor.jpg",
+	} {
+		opt := tm.Opts[0]
+		opt.Filter = filter
+		urls, err := tm.thumbURLs(opt, DefaultNameTemplate, "")
+		if err != nil {
+			t.Fatal("Failed to generate the thumbURL :", err)
+		}
+		if len(urls) != 1 || urls[0].Path != expected {
+			t.Fatalf("got: %v, expected: %s", urls, expected)
+		}
+	}
+}
+
+func Test_GenerateThumbnailsFilters(t *testing.T) {
+	dir, err := ioutil.TempDir("", "thumbnailer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	th := New(WithFilter(Box))
+	tm := testThumbnailerMessage()
+	tm.DstFolder = "file://" + dir
+	tm.Opts = []ThumbnailOpt{{Width: 50}, {Width: 50, Filter: "Lanczos"}, {Width: 20}}
+	results, err := th.Process(&tm)
+	if err != nil {
+		t.Fatal("An error occured while generating the thumbs :", err)
+	}
+	if len(results) != 3 {
+		t.Fatalf("expected 3 results, got %d", len(results))
+	}
+	for _, name := range []string{"pic_s50x38_box.jpg", "pic_s50x38_lanczos.jpg", "pic_s20x15_box.jpg"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Fatal("Missing thumb:", err)
+		}
+	}
+
+	tm.Opts = []ThumbnailOpt{{Width: 50, Filter: "bicubic"}}
+	if _, err := th.Process(&tm); err == nil {
+		t.Fatal("expected an error for an unsupported filter")
+	}
+}
+
+func Test_sizeHint(t *testing.T) {
+	th := New()
+	bounds := image.Rect(0, 0, 6000, 4000)
+	tm := ThumbnailerMessage{Opts: []ThumbnailOpt{{Width: 200}, {Height: 300}}}
+	// 300px high needs 600px once oversampled
+	if hint := th.sizeHint(tm.Opts, bounds); hint != image.Pt(900, 600) {
+		t.Fatalf("got: %v, expected: (900,600)", hint)
+	}
+	tm.Opts = append(tm.Opts, ThumbnailOpt{Width: 50, Filter: NearestNeighbor})
+	if hint := th.sizeHint(tm.Opts, bounds); hint != bounds.Size() {
+		t.Fatalf("got: %v, expected: %v", hint, bounds.Size())
+	}
+	if denom := scaleDenom(6000, 4000, image.Pt(900, 600)); denom != 4 {
+		t.Fatalf("got: 1/%d, expected: 1/4", denom)
+	}
+}
+
+func Test_GenerateThumbnailsDecodeHint(t *testing.T) {
+	dir, err := ioutil.TempDir("", "thumbnailer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	th := New()
+	tm := testThumbnailerMessage()
+	tm.DstFolder = "file://" + dir
+	tm.Opts = []ThumbnailOpt{
+		{Width: 100},
+		{Width: 50, Rect: &rectangle{Min: [2]int{800, 600}, Max: [2]int{1632, 1224}}},
+	}
+	src, err := th.openSource(&tm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	img, err := src.decode(&th.codec, th.sizeHint(tm.Opts, src.bounds))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bounds := src.bounds; bounds.Size() != image.Pt(1632, 1224) || img.Bounds().Size() != decodeHintSize {
+		t.Fatalf("got: %v decoded at %v, expected: 1632x1224 decoded at %v", bounds.Size(), img.Bounds().Size(), decodeHintSize)
+	}
+	results, err := th.Process(&tm)
+	if err != nil {
+		t.Fatal("An error occured while generating the thumbs :", err)
+	}
+	for _, name := range []string{"pic_s100x75.jpg", "pic_c800-600-1632-1224_s50x38.jpg"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Fatal("Missing thumb:", err, results)
+		}
+	}
+}
+
+func Test_GenerateThumbnailsOverwrite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "thumbnailer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The source is copied to control its modification time
+	data, err := ioutil.ReadFile(filepath.Join("testdata", "pic.jpg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srcPath := filepath.Join(dir, "src.jpg")
+	if err := ioutil.WriteFile(srcPath, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	srcTime := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(srcPath, srcTime, srcTime); err != nil {
+		t.Fatal(err)
+	}
+
+	th := New()
+	tm := ThumbnailerMessage{
+		SrcImage:  "file://" + srcPath,
+		DstFolder: "file://" + dir,
+		Opts:      []ThumbnailOpt{{Width: 100}, {Height: 50}},
+	}
+	generate := func(overwrite Overwrite) (skipped int) {
+		tm.Overwrite = overwrite
+		results, err := th.Process(&tm)
+		if err != nil {
+			t.Fatal("An error occured while generating the thumbs :", err)
+		}
+		for _, r := range results {
+			if r.Skipped {
+				skipped++
+			}
+		}
+		return skipped
+	}
+
+	if skipped := generate(OverwriteNever); skipped != 0 {
+		t.Fatalf("expected the missing thumbs to be generated, %d skipped", skipped)
+	}
+	if skipped := generate(OverwriteNever); skipped != 2 {
+		t.Fatalf("expected the existing thumbs to be skipped, %d skipped", skipped)
+	}
+	if skipped := generate(OverwriteIfOlder); skipped != 2 {
+		t.Fatalf("expected the thumbs newer than the source to be skipped, %d skipped", skipped)
+	}
+	old := srcTime.Add(-time.Hour)
+	if err := os.Chtimes(filepath.Join(dir, "src_s100x75.jpg"), old, old); err != nil {
+		t.Fatal(err)
+	}
+	if skipped := generate(OverwriteIfOlder); skipped != 1 {
+		t.Fatalf("expected the thumb older than the source to be regenerated, %d skipped", skipped)
+	}
+	if skipped := generate(""); skipped != 0 {
+		t.Fatalf("expected the thumbs to be regenerated, %d skipped", skipped)
+	}
+}
+
+func Test_GenerateThumbnailsOverwriteS3(t *testing.T) {
+	data, err := ioutil.ReadFile(filepath.Join("testdata", "pic.jpg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s3 := newFakeS3()
+	s3.put("/bucket/src/pic.jpg", data, time.Now().Add(-time.Hour))
+	srv := httptest.NewServer(s3)
+	defer srv.Close()
+
+	th := New(WithStorage("s3", s3Stack(t, srv)))
+	tm := ThumbnailerMessage{
+		SrcImage:  "s3://bucket/src/pic.jpg",
+		DstFolder: "s3://bucket/thumbs",
+		Opts:      []ThumbnailOpt{{Width: 100}},
+		Overwrite: OverwriteIfOlder,
+	}
+	for i, skipped := range []bool{false, true} {
+		results, err := th.Process(&tm)
+		if err != nil {
+			t.Fatal("An error occured while generating the thumbs :", err)
+		}
+		if len(results) != 1 || results[0].Skipped != skipped {
+			t.Fatalf("run %d: expected Skipped to be %v, got %v", i, skipped, results)
+		}
+	}
+	if uploads := s3.uploads(); len(uploads) != 1 {
+		t.Fatalf("expected a single upload, got %v", uploads)
+	}
+}
+
+func Test_thumbURLTemplates(t *testing.T) {
+	tm := testThumbnailerMessage()
+	opt := ThumbnailOpt{Width: 100, Height: 75, Filter: Lanczos, Rect: &rectangle{Min: [2]int{0, 0}, Max: [2]int{400, 300}}}
+	for tmpl, expected := range map[string]string{
+		"":                         "/tmp/pic_c0-0-400-300_s100x75_lanczos.jpg",
+		"folder":                   "/tmp/pic/100x75_c0-0-400-300_lanczos.jpg",
+		"{dir}/{w}/{h}/{name}.png": "/tmp/100/75/pic.png",
+		"{dir}/{name}.{ext}":       "/tmp/pic.jpg",
+	} {
+		tmpl, err := ParseNameTemplate(tmpl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		urls, err := tm.thumbURLs(opt, tmpl, "")
+		if err != nil {
+			t.Fatal("Failed to generate the thumbURL :", err)
+		}
+		if len(urls) != 1 || urls[0].Path != expected {
+			t.Fatalf("got: %v, expected: %s", urls, expected)
+		}
+	}
+	for _, tmpl := range []string{"{dir}/{nam}.jpg", "{dir}/{name.jpg", "static.jpg", "/etc/{name}.{ext}", "{name}/{dir}/{w}.jpg", "{dir}/../other/{name}.{ext}", "{dir}/..{crop}/{name}.{ext}", "{dir}/./{name}.{ext}"} {
+		if _, err := ParseNameTemplate(tmpl); err == nil {
+			t.Fatalf("expected an error for %q", tmpl)
+		}
+	}
+}
+
+func Test_thumbURLsCollisions(t *testing.T) {
+	th := New()
+	tm := testThumbnailerMessage()
+	tm.NameTemplate = "{dir}/{name}_{w}.{ext}"
+	tm.Opts = []ThumbnailOpt{{Width: 100, Height: 100}, {Width: 100, Height: 50}}
+	if _, err := th.Process(&tm); err == nil {
+		t.Fatal("expected an error for colliding thumbnails")
+	}
+
+	tm = testThumbnailerMessage()
+	tm.DstFolder = filepath.Dir(tm.SrcImage)
+	tm.NameTemplate = "{dir}/{name}.{ext}"
+	if _, err := th.Process(&tm); err == nil {
+		t.Fatal("expected an error for a thumbnail overwriting the source")
+	}
+}
+
+func Test_GenerateThumbnailsContent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "thumbnailer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	data, err := ioutil.ReadFile(filepath.Join("testdata", "pic.jpg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(data)
+	srcHash := hex.EncodeToString(sum[:])
+
+	// Two copies of the source share their thumbnails
+	th := New()
+	for _, name := range []string{"a.jpg", "b.jpg"} {
+		srcPath := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(srcPath, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		tm := ThumbnailerMessage{
+			SrcImage:     "file://" + srcPath,
+			DstFolder:    "file://" + filepath.Join(dir, "thumbs"),
+			Opts:         []ThumbnailOpt{{Width: 100}},
+			Overwrite:    OverwriteNever,
+			NameTemplate: "content",
+		}
+		results, err := th.Process(&tm)
+		if err != nil {
+			t.Fatal("An error occured while generating the thumbs :", err)
+		}
+		expected := filepath.Join(dir, "thumbs", srcHash[:2], srcHash[2:4], srcHash+"_100x75.jpg")
+		if len(results) != 1 || results[0].Thumbnail.Path != expected {
+			t.Fatalf("got: %v, expected: %s", results, expected)
+		}
+		if results[0].SourceHash != srcHash {
+			t.Fatalf("got: %s, expected: %s", results[0].SourceHash, srcHash)
+		}
+		if skipped := name == "b.jpg"; results[0].Skipped != skipped {
+			t.Fatalf("expected Skipped to be %v for %s", skipped, name)
+		}
+	}
+}
+
+func Test_GenerateThumbnailsContentS3(t *testing.T) {
+	data, err := ioutil.ReadFile(filepath.Join("testdata", "pic.jpg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(data)
+	srcHash := hex.EncodeToString(sum[:])
+	s3 := newFakeS3()
+	srv := httptest.NewServer(s3)
+	defer srv.Close()
+
+	// Two copies of the source share their thumbnails
+	th := New(WithStorage("s3", s3Stack(t, srv)))
+	for _, name := range []string{"a.jpg", "b.jpg"} {
+		s3.put("/bucket/src/"+name, data, time.Now())
+		tm := ThumbnailerMessage{
+			SrcImage:     "s3://bucket/src/" + name,
+			DstFolder:    "s3://bucket/thumbs",
+			Opts:         []ThumbnailOpt{{Width: 100}},
+			Overwrite:    OverwriteNever,
+			NameTemplate: "content",
+		}
+		results, err := th.Process(&tm)
+		if err != nil {
+			t.Fatal("An error occured while generating the thumbs :", err)
+		}
+		expected := "s3://bucket/thumbs/" + srcHash[:2] + "/" + srcHash[2:4] + "/" + srcHash + "_100x75.jpg"
+		if len(results) != 1 || results[0].Thumbnail.String() != expected || results[0].SourceHash != srcHash {
+			t.Fatalf("got: %v, expected: %s", results, expected)
+		}
+		if skipped := name == "b.jpg"; results[0].Skipped != skipped {
+			t.Fatalf("expected Skipped to be %v for %s", skipped, name)
+		}
+	}
+	if uploads := s3.uploads(); len(uploads) != 1 {
+		t.Fatalf("expected a single upload, got %v", uploads)
+	}
+}
+
+func Test_GenerateThumbnailsDestinations(t *testing.T) {
+	data, err := ioutil.ReadFile(filepath.Join("testdata", "pic.jpg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := NewMemStorage()
+	m.Put("src/pic.jpg", data)
+	th := New(WithStorage("mem", m.Storage))
+	tm := ThumbnailerMessage{
+		SrcImage:   "mem://src/pic.jpg",
+		DstFolder:  "mem://a",
+		DstFolders: []string{"mem://b", "unknown://c"},
+		Opts: []ThumbnailOpt{
+			{Width: 100},
+			{Width: 50, DstImages: []string{"mem://a/small.jpg", "mem://b/small.png"}},
+		},
+	}
+	results, err := th.Process(&tm)
+	if err == nil {
+		t.Fatal("expected an error for the unknown scheme")
+	}
+	failed := 0
+	for _, r := range results {
+		if r.Err != nil {
+			failed++
+			if r.Thumbnail.Scheme != "unknown" {
+				t.Fatalf("unexpected error for %s: %s", r.Thumbnail, r.Err)
+			}
+		}
+	}
+	if len(results) != 5 || failed != 1 {
+		t.Fatalf("expected 5 results with 1 error, got %v", results)
+	}
+	a, _ := m.Bytes("a/pic_s100x75.jpg")
+	b, _ := m.Bytes("b/pic_s100x75.jpg")
+	if len(a) == 0 || string(a) != string(b) {
+		t.Fatal("expected the same thumbnail in both folders")
+	}
+	for _, key := range []string{"a/small.jpg", "b/small.png"} {
+		if size, err := m.Size(key); err != nil || size != image.Pt(50, 38) {
+			t.Fatalf("%s got: %v %v, expected: 50x38", key, size, err)
+		}
+	}
+}
+
+func Test_GenerateThumbnailsAllowDestination(t *testing.T) {
+	data, err := ioutil.ReadFile(filepath.Join("testdata", "pic.jpg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := NewMemStorage()
+	m.Put("src/pic.jpg", data)
+	th := New(WithStorage("mem", m.Storage))
+	errNotAllowed := errors.New("not allowed")
+	tm := ThumbnailerMessage{
+		SrcImage:     "mem://src/pic.jpg",
+		DstFolder:    "mem://bucket/ci/",
+		NameTemplate: "{dir}/{w}x{h}/{name}.{ext}",
+		Opts:         []ThumbnailOpt{{Width: 100}, {Height: 50}},
+		AllowDestination: func(thumbURL *url.URL) error {
+			if thumbURL.Path != "/ci/100x75/pic.jpg" {
+				return fmt.Errorf("%s %w", thumbURL, errNotAllowed)
+			}
+			return nil
+		},
+	}
+	if _, err := th.Process(&tm); !errors.Is(err, errNotAllowed) {
+		t.Fatalf("expected the resolved thumbnail to be refused, got: %v", err)
+	}
+	if _, ok := m.Bytes("bucket/ci/100x75/pic.jpg"); ok {
+		t.Fatal("expected no thumbnail to be saved")
+	}
+}
+
+func Test_Destinations(t *testing.T) {
+	tm := ThumbnailerMessage{
+		DstFolder:  "mem://a",
+		DstFolders: []string{"mem://b"},
+		Opts: []ThumbnailOpt{
+			{Width: 100},
+			{Width: 50, DstImage: "mem://c/small.jpg", DstImages: []string{"mem://a/small.png"}},
+			{Width: 20},
+		},
+	}
+	expected := []string{"mem://a", "mem://b", "mem://c/small.jpg", "mem://a/small.png"}
+	if dsts := tm.Destinations(); !reflect.DeepEqual(dsts, expected) {
+		t.Fatalf("got: %v, expected: %v", dsts, expected)
+	}
+}
+
+func Test_Clone(t *testing.T) {
+	m := NewMemStorage()
+	th := New(WithWorkers(2))
+	c := th.Clone(WithStorage("mem", m.Storage), WithWorkers(2))
+	if c.workers != th.workers || c.flights != th.flights {
+		t.Fatal("expected the clone to share the workers and the flights")
+	}
+	if _, ok := th.storages["mem"]; ok {
+		t.Fatal("expected the storages of the clone not to be added to the original")
+	}
+	if c = th.Clone(WithWorkers(4)); cap(c.workers) != 4 || cap(th.workers) != 2 {
+		t.Fatalf("expected new workers, got %d and %d", cap(c.workers), cap(th.workers))
+	}
+}
+
+func Test_CheckImage(t *testing.T) {
+	data, err := ioutil.ReadFile(filepath.Join("testdata", "pic.jpg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	th := New()
+	if err := th.CheckImage(bytes.NewReader(data), ".JPG"); err != nil {
+		t.Fatal(err)
+	}
+	for ext, content := range map[string][]byte{
+		".html": data,
+		".png":  data,
+		".jpg":  []byte("<html></html>"),
+	} {
+		if err := th.CheckImage(bytes.NewReader(content), ext); err == nil {
+			t.Errorf("expected an error for %s", ext)
+		}
+	}
+}